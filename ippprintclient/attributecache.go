@@ -0,0 +1,297 @@
+package ippprintclient
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
+)
+
+const attributeCacheUsage = `usage: attribute-cache [list|show|purge|warm|export|import]
+	list - list the cached printers: uri, age, make and model
+	show <uri> - print the cached attributes of a printer and what was learned about sending jobs to it
+	purge [-expired|-uri <uri>] - remove expired entries, one printer, or everything
+	warm <uri>... - fetch and cache the attributes of the printers. Use - to read uris from stdin, one per line
+	export [file] - write the cache entries to file, or stdout
+	import [file] - read cache entries written by export from file, or stdin`
+
+// attributeCacheCommand Maintenance commands for the printer attribute cache.
+// Output goes to stdout, so it can be piped into other tools.
+func attributeCacheCommand(args []string, attribCache *printerattributecache.PrinterAttributeCache, httpClient ippclient.HttpClientInterface) error {
+	opErr := &OperationError{
+		Type: ErrAttributeCache,
+	}
+
+	if attribCache == nil {
+		opErr.Err = fmt.Errorf("printer attribute cache unavailable, check -printerAttributeCachePath")
+		return opErr
+	}
+	if len(args) == 0 {
+		opErr.Err = errors.New(attributeCacheUsage)
+		return opErr
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		err = listAttributeCache(os.Stdout, attribCache)
+	case "show":
+		if len(args) != 2 {
+			opErr.Err = fmt.Errorf("show expects one printer uri")
+			return opErr
+		}
+		err = showAttributeCache(os.Stdout, attribCache, args[1])
+	case "purge":
+		err = purgeAttributeCache(os.Stdout, attribCache, args[1:])
+	case "warm":
+		err = warmAttributeCache(os.Stdout, attribCache, httpClient, args[1:])
+	case "export":
+		err = exportAttributeCache(os.Stdout, attribCache, args[1:])
+	case "import":
+		err = importAttributeCache(os.Stdout, attribCache, args[1:])
+	default:
+		opErr.Err = errors.New(attributeCacheUsage)
+		return opErr
+	}
+
+	if err != nil {
+		var oe *OperationError
+		if errors.As(err, &oe) {
+			return err
+		}
+		opErr.Err = err
+		return opErr
+	}
+	return nil
+}
+
+func listAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache) error {
+	entries, err := attribCache.Entries()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "URI\tAGE\tSTATE AGE\tEXPIRED\tMAKE AND MODEL")
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n",
+			entry.URI,
+			entryAge(entry.CapabilitiesUpdated),
+			entryAge(entry.StateUpdated),
+			entry.Expired,
+			entry.Attributes.PrinterMakeModel)
+	}
+	return tw.Flush()
+}
+
+func entryAge(updated time.Time) string {
+	if updated.IsZero() {
+		return "-"
+	}
+	return time.Since(updated).Round(time.Second).String()
+}
+
+func showAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache, uri string) error {
+	entry, err := attribCache.Lookup(uri)
+	if errors.Is(err, printerattributecache.ErrNotExist) {
+		return &OperationError{
+			Type: ErrAttributeCacheNotFound,
+			Err:  fmt.Errorf("%v is not cached", uri),
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entry)
+}
+
+func purgeAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	expired := flags.Bool("expired", false, "only remove expired entries")
+	uri := flags.String("uri", "", "only remove the entry for this printer uri")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *expired && *uri != "" {
+		return fmt.Errorf("purge takes either -expired or -uri, not both")
+	}
+
+	if *uri != "" {
+		err := attribCache.Purge(*uri)
+		if errors.Is(err, printerattributecache.ErrNotExist) {
+			return &OperationError{
+				Type: ErrAttributeCacheNotFound,
+				Err:  fmt.Errorf("%v is not cached", *uri),
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "purged %v\n", *uri)
+		return nil
+	}
+
+	var removed int
+	var err error
+	if *expired {
+		removed, err = attribCache.PurgeExpired()
+	} else {
+		removed, err = attribCache.PurgeAll()
+	}
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "purged %d entries\n", removed)
+	return nil
+}
+
+// warmAttributeCache Fetch and cache the attributes of each printer. Every printer is tried,
+// the command fails if any of them couldn't be cached.
+func warmAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache, httpClient ippclient.HttpClientInterface, args []string) error {
+	uris, err := readURIList(args, os.Stdin)
+	if err != nil {
+		return err
+	}
+	if len(uris) == 0 {
+		return fmt.Errorf("warm expects at least one printer uri")
+	}
+
+	client, err := ippclient.NewIPPClient(ippclient.SetHTTPClient(httpClient))
+	if err != nil {
+		return fmt.Errorf("failed to create ipp client, err: %v", err)
+	}
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			pclog.Errorf("failed to close IPP client: %v", err)
+		}
+	}()
+
+	var failed []string
+	for _, uri := range uris {
+		attributes, err := getPrinterAttributesWithRetry(client, uri)
+		if err == nil {
+			// As checkPrinter, only a ready printer's state is worth caching.
+			if ready, reason := isPrinterReady(attributes); !ready {
+				err = fmt.Errorf("printer not ready: %s", reason)
+			} else {
+				err = attribCache.SetPrinterAttributes(uri, attributes)
+			}
+		}
+		if err != nil {
+			pclog.Errorf("attribute-cache warm: %v failed: %v", uri, err)
+			_, _ = fmt.Fprintf(w, "failed %v: %v\n", uri, err)
+			failed = append(failed, uri)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "cached %v\n", uri)
+	}
+
+	if len(failed) > 0 {
+		return &OperationError{
+			Type: ErrAttributeCacheWarm,
+			Err:  fmt.Errorf("failed to cache %d of %d printers: %v", len(failed), len(uris), failed),
+		}
+	}
+	return nil
+}
+
+// readURIList Get the uris from args, a "-" argument reads them from stdin, one per line.
+func readURIList(args []string, stdin io.Reader) ([]string, error) {
+	var uris []string
+	for _, arg := range args {
+		if arg != "-" {
+			uris = append(uris, arg)
+			continue
+		}
+
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				uris = append(uris, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read uris: %v", err)
+		}
+	}
+	return uris, nil
+}
+
+// getPrinterAttributesWithRetry Get the printer attributes, retrying up to ippGetAttributeRetries times.
+func getPrinterAttributesWithRetry(client *ippclient.IPPClient, printerURI string) (*ippclient.PrinterAttributes, error) {
+	var err error
+	for attempt := 1; attempt <= *ippGetAttributeRetries; attempt++ {
+		var resp *ippclient.PrinterAttributesResponse
+		resp, err = client.GetPrinterAttributes(printerURI, printerReadyAttributes)
+		if err == ippclient.ErrMalformedAttributes {
+			return nil, err
+		}
+		if err != nil {
+			// Sleep for 500ms before retrying.
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		if !resp.StatusCode.IsStatusOK() {
+			return nil, fmt.Errorf("get-printer-attributes failed with status %s", resp.StatusMessage())
+		}
+		return resp.PrinterAttributes, nil
+	}
+	return nil, err
+}
+
+func exportAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache, args []string) (err error) {
+	out := w
+	if len(args) > 0 && args[0] != "-" {
+		f, createErr := os.Create(args[0])
+		if createErr != nil {
+			return fmt.Errorf("failed to create export file: %v", createErr)
+		}
+		defer func() {
+			if closeErr := f.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("failed to write export file: %v", closeErr)
+			}
+		}()
+		out = f
+	}
+
+	exported, err := attribCache.Export(out)
+	if err != nil {
+		return err
+	}
+	pclog.Supportf("attribute-cache export: exported %d entries", exported)
+	return nil
+}
+
+func importAttributeCache(w io.Writer, attribCache *printerattributecache.PrinterAttributeCache, args []string) error {
+	var in io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open import file: %v", err)
+		}
+		defer func() { _ = f.Close() }()
+		in = f
+	}
+
+	imported, err := attribCache.Import(in)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "imported %d entries\n", imported)
+	return nil
+}
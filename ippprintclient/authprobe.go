@@ -0,0 +1,100 @@
+package ippprintclient
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ipp"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// probeCredentials Settle the credentials for a Print-Job before any of the document is sent, so an HTTP 401 costs
+// a small request rather than a whole upload. The probe is a Validate-Job with the job template, or a
+// Get-Printer-Attributes if the printer doesn't support Validate-Job, retried on HTTP 401 as Print-Job is: once with
+// the default credentials, whether or not the ticket has credentials, then up to ippMaxUnauthorisedAttempts times.
+// Fails with ErrPrintUnauthorised if the printer keeps rejecting the credentials. Other probe failures are only
+// logged, the job is sent and handles them itself.
+// Create-Job settles the credentials itself before Send-Document, so jobs sent that way don't need the probe.
+func (p *ippPrinter) probeCredentials(ctx context.Context, printerURI string, jobTemplate *ippclient.PrintJobTemplateAttributes,
+	printerAttrs *ippclient.PrinterAttributes) error {
+
+	operation := probeOperation(printerAttrs)
+	return p.settleCredentials(ctx, operation, func(credentials *ippclient.IPPCredentials) error {
+		var err error
+		if operation == validateJobOperation {
+			_, err = p.ippClient.ValidateJob(printerURI, jobTemplate, credentials)
+		} else {
+			_, err = p.ippClient.GetPrinterAttributes(printerURI, []string{ippclient.PrinterState}, credentials)
+		}
+		return err
+	})
+}
+
+// probeOperation The operation probing the credentials: Validate-Job, or Get-Printer-Attributes if the printer
+// doesn't support it.
+func probeOperation(printerAttrs *ippclient.PrinterAttributes) string {
+	if operationsSupported(printerAttrs, []ipp.Operation{ipp.OperationValidateJob}) {
+		return validateJobOperation
+	}
+	return getPrinterAttrsOperation
+}
+
+// settleCredentials Send the probe request with the printer's credentials until the printer accepts them, or
+// anything but an HTTP 401 makes the probe inconclusive, see probeCredentials.
+func (p *ippPrinter) settleCredentials(ctx context.Context, operation string, request func(credentials *ippclient.IPPCredentials) error) error {
+	skipBackoff := true
+	retryWithDefaultCredentials := false
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !skipBackoff {
+			jitter := rand.Int63n(retryBackoffSeconds)
+			<-time.After(time.Duration(retryBackoffSeconds+jitter) * time.Second)
+		}
+		skipBackoff = false
+
+		startTime := time.Now()
+		err := request(p.Credentials)
+		duration := time.Since(startTime).String()
+
+		reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err)
+		if err == nil || !isHttpStatusError || reqErr == nil || reqErr.StatusCode != http.StatusUnauthorized {
+			if err != nil {
+				pclog.Supportf("credentials probe inconclusive, sending the job: %v", err)
+			}
+			processingLogger.LogOperationAttempt(operation, attempt, "credentials probe done", duration)
+			return nil
+		}
+
+		if !retryWithDefaultCredentials {
+			msg := "credentials probe: retry with default ipp credentials"
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(operation, attempt, msg, duration)
+			p.Credentials = defaultIppCredentials
+			retryWithDefaultCredentials = true
+			skipBackoff = true
+			continue
+		}
+
+		// CUPS retries on HTTP 401 to get around printer quirks, as the job operations do.
+		if attempt <= *ippMaxUnauthorisedAttempts {
+			msg := fmt.Sprintf("credentials probe received HTTP 401; trying again - attempt %d/%d", attempt, *ippMaxUnauthorisedAttempts)
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(operation, attempt, msg, duration)
+			continue
+		}
+
+		msg := "credentials probe: printer rejected the credentials"
+		pclog.Errorf(msg)
+		processingLogger.LogOperationAttempt(operation, attempt, msg, duration)
+		return &OperationError{
+			Type: ErrPrintUnauthorised,
+			Err:  fmt.Errorf("%s: %v", msg, err),
+		}
+	}
+}
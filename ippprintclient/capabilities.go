@@ -0,0 +1,127 @@
+package ippprintclient
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// How to handle ticket attributes the printer doesn't support.
+const (
+	capabilityModeBestEffort = "best-effort" // Downgrade them to something the printer supports.
+	capabilityModeStrict     = "strict"      // Fail the job with ErrPrintUnsupportedAttributes.
+)
+
+// The job template attributes reconciled with the printer's capabilities.
+const (
+	attributeSides          = "sides"
+	attributePrintColorMode = "print-color-mode"
+	attributeCopies         = "copies"
+)
+
+const (
+	sidesOneSided       = "one-sided"
+	colorModeMonochrome = "monochrome"
+)
+
+// capabilityChange A job attribute the printer doesn't support and what it is downgraded to.
+type capabilityChange struct {
+	attribute string
+	requested string
+	supported string
+}
+
+func (c capabilityChange) String() string {
+	return fmt.Sprintf("%s=%s (downgraded to %s)", c.attribute, c.requested, c.supported)
+}
+
+// unsupportedCapabilities Compare the job's sides, color mode and copies with what the printer supports.
+// Attributes the printer doesn't report support for are left alone.
+func unsupportedCapabilities(jobAttrs *ippclient.PrintJobTemplateAttributes, printerAttrs *ippclient.PrinterAttributes) []capabilityChange {
+	var changes []capabilityChange
+
+	if jobAttrs.AttributesSides != "" && len(printerAttrs.SidesSupported) > 0 &&
+		!containsFold(printerAttrs.SidesSupported, jobAttrs.AttributesSides) {
+		changes = append(changes, capabilityChange{
+			attribute: attributeSides,
+			requested: jobAttrs.AttributesSides,
+			supported: preferredValue(printerAttrs.SidesSupported, sidesOneSided),
+		})
+	}
+
+	if jobAttrs.PrintColorMode != "" && len(printerAttrs.PrintColorModeSupported) > 0 &&
+		!containsFold(printerAttrs.PrintColorModeSupported, jobAttrs.PrintColorMode) {
+		changes = append(changes, capabilityChange{
+			attribute: attributePrintColorMode,
+			requested: jobAttrs.PrintColorMode,
+			supported: preferredValue(printerAttrs.PrintColorModeSupported, colorModeMonochrome),
+		})
+	}
+
+	copiesRange := printerAttrs.CopiesSupported
+	if copiesRange.UpperBound > 0 {
+		copies := jobAttrs.AttributeCopies
+		if copies > copiesRange.UpperBound {
+			copies = copiesRange.UpperBound
+		} else if copies < copiesRange.LowerBound {
+			copies = copiesRange.LowerBound
+		}
+		if copies != jobAttrs.AttributeCopies {
+			changes = append(changes, capabilityChange{
+				attribute: attributeCopies,
+				requested: strconv.Itoa(jobAttrs.AttributeCopies),
+				supported: strconv.Itoa(copies),
+			})
+		}
+	}
+
+	return changes
+}
+
+// preferredValue The preferred value if the printer supports it, otherwise the first supported value.
+func preferredValue(supported []string, preferred string) string {
+	if containsFold(supported, preferred) {
+		return preferred
+	}
+	return supported[0]
+}
+
+// reconcileCapabilities Make the job fit what the printer supports. In strict mode any unsupported attribute
+// fails the job with ErrPrintUnsupportedAttributes. Otherwise they are downgraded and each change reported.
+func reconcileCapabilities(jobAttrs *ippclient.PrintJobTemplateAttributes, printerAttrs *ippclient.PrinterAttributes, mode string) error {
+	changes := unsupportedCapabilities(jobAttrs, printerAttrs)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if mode == capabilityModeStrict {
+		var unsupported []string
+		for _, change := range changes {
+			unsupported = append(unsupported, fmt.Sprintf("%s=%s", change.attribute, change.requested))
+		}
+		msg := fmt.Sprintf("attributes not supported by printer: %s", strings.Join(unsupported, ", "))
+		pclog.Errorf(msg)
+		return &OperationError{
+			Type: ErrPrintUnsupportedAttributes,
+			Err:  errors.New(msg),
+		}
+	}
+
+	for _, change := range changes {
+		switch change.attribute {
+		case attributeSides:
+			jobAttrs.AttributesSides = change.supported
+		case attributePrintColorMode:
+			jobAttrs.PrintColorMode = change.supported
+		case attributeCopies:
+			jobAttrs.AttributeCopies, _ = strconv.Atoi(change.supported)
+		}
+		pclog.Supportf("attribute not supported by printer: %v", change)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, fmt.Sprintf("capability downgrade: %v", change), "")
+	}
+	return nil
+}
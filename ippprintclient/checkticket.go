@@ -0,0 +1,247 @@
+package ippprintclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
+)
+
+// check-ticket verdicts.
+const (
+	verdictPass     = "pass"     // The job would print as the ticket asks.
+	verdictDegraded = "degraded" // The job would print, but not as the ticket asks.
+	verdictFail     = "fail"     // The job would fail.
+)
+
+// ticketVerdict How a ticket would print on a printer.
+type ticketVerdict struct {
+	verdict   string
+	reasons   []string
+	operation string
+	docFormat string
+}
+
+func (v *ticketVerdict) degrade(format string, args ...interface{}) {
+	if v.verdict == verdictPass {
+		v.verdict = verdictDegraded
+	}
+	v.reasons = append(v.reasons, fmt.Sprintf(format, args...))
+}
+
+func (v *ticketVerdict) fail(format string, args ...interface{}) {
+	v.verdict = verdictFail
+	v.reasons = append(v.reasons, fmt.Sprintf(format, args...))
+}
+
+// checkTicketCommand Check whether a ticket would print as requested on a printer, without creating a job.
+// The printer attributes come from the cache if it has them. The verdict and its reasons go to w.
+func checkTicketCommand(w io.Writer, ticketPath, printerURI string, httpClient ippclient.HttpClientInterface,
+	attribCache *printerattributecache.PrinterAttributeCache) error {
+
+	opErr := &OperationError{
+		Type: ErrCheckTicket,
+	}
+
+	if ticketPath == "" || printerURI == "" {
+		opErr.Err = fmt.Errorf("ticketPath and printerURI are required")
+		return opErr
+	}
+
+	ticketAttrs, err := jobticket.GetPrintJobAttributes(ticketPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(w, "%s\n- %v\n", verdictFail, err)
+		return &OperationError{
+			Type: ErrCheckTicketFail,
+			Err:  err,
+		}
+	}
+
+	client, err := ippclient.NewIPPClient(ippclient.SetHTTPClient(httpClient))
+	if err != nil {
+		opErr.Err = fmt.Errorf("failed to create ipp client, err: %v", err)
+		return opErr
+	}
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			pclog.Errorf("failed to close IPP client: %v", err)
+		}
+	}()
+	// Background refreshes of the attribute cache use the client, let them finish before it is closed.
+	defer attribCache.Wait()
+
+	fetch := func(context.Context, bool) (*ippclient.PrinterAttributes, error) {
+		return getPrinterAttributesWithRetry(client, printerURI)
+	}
+
+	var printerAttrs *ippclient.PrinterAttributes
+	if attribCache != nil {
+		printerAttrs, _, err = attribCache.RefreshPrinterAttributes(context.Background(), printerURI, fetch)
+	} else {
+		printerAttrs, err = fetch(context.Background(), false)
+	}
+	if err != nil {
+		opErr.Err = fmt.Errorf("get-printer-attributes:[%v] failed err: %v", printerURI, err)
+		return opErr
+	}
+
+	verdict := checkTicketCompatibility(ticketAttrs, printerURI, printerAttrs)
+
+	_, _ = fmt.Fprintln(w, verdict.verdict)
+	if verdict.operation != "" {
+		_, _ = fmt.Fprintf(w, "operation: %s\n", verdict.operation)
+	}
+	if verdict.docFormat != "" {
+		_, _ = fmt.Fprintf(w, "document-format: %s\n", verdict.docFormat)
+	}
+	for _, reason := range verdict.reasons {
+		_, _ = fmt.Fprintf(w, "- %s\n", reason)
+	}
+
+	switch verdict.verdict {
+	case verdictDegraded:
+		return &OperationError{
+			Type: ErrCheckTicketDegraded,
+			Err:  fmt.Errorf("ticket would print degraded: %s", strings.Join(verdict.reasons, "; ")),
+		}
+	case verdictFail:
+		return &OperationError{
+			Type: ErrCheckTicketFail,
+			Err:  fmt.Errorf("ticket would fail: %s", strings.Join(verdict.reasons, "; ")),
+		}
+	}
+	return nil
+}
+
+// checkTicketCompatibility Run the same operation selection, format mapping, finishings mapping and media
+// selection as print-job, and compare the job it would send with the ticket.
+func checkTicketCompatibility(ticketAttrs *jobticket.JobTicket, printerURI string, printerAttrs *ippclient.PrinterAttributes) *ticketVerdict {
+	verdict := &ticketVerdict{verdict: verdictPass}
+
+	if chain := operationChain(printerURI, printerAttrs); len(chain) > 0 {
+		verdict.operation = operationDescription(chain[0])
+	} else {
+		verdict.fail("printer supports none of the operations in -ippOperationChain %q", *ippOperationChain)
+	}
+
+	job, err := buildJob(ticketAttrs, printerAttrs)
+	if err != nil {
+		verdict.fail("%v", unwrapOperationError(err))
+		return verdict
+	}
+	verdict.docFormat = job.docFormat
+
+	if job.docFormat == ticketAttrs.DocumentFormat && !containsFold(printerAttrs.DocumentFormatSupported, job.docFormat) {
+		verdict.degrade("printer doesn't list document-format %s, it is sent anyway", job.docFormat)
+	}
+
+	if job.emulatedCopies > 1 {
+		verdict.reasons = append(verdict.reasons, fmt.Sprintf("copies emulated by sending the document %d times", job.emulatedCopies))
+	}
+
+	checkCapabilities(verdict, ticketAttrs, job)
+	checkFinishings(verdict, ticketAttrs, printerAttrs)
+	checkMedia(verdict, ticketAttrs, printerAttrs)
+	checkOptionalJobAttributes(verdict, ticketAttrs, job.template)
+
+	return verdict
+}
+
+func unwrapOperationError(err error) error {
+	if opErr, ok := err.(*OperationError); ok && opErr.Err != nil {
+		return opErr.Err
+	}
+	return err
+}
+
+func checkCapabilities(verdict *ticketVerdict, ticketAttrs *jobticket.JobTicket, job *preparedJob) {
+	if job.template.AttributesSides != ticketAttrs.Sides {
+		verdict.degrade("%s %s not supported, %s used", attributeSides, ticketAttrs.Sides, job.template.AttributesSides)
+	}
+	if job.template.PrintColorMode != ticketAttrs.PrintColorMode {
+		verdict.degrade("%s %s not supported, %s used", attributePrintColorMode, ticketAttrs.PrintColorMode, job.template.PrintColorMode)
+	}
+	copies := job.template.AttributeCopies * job.emulatedCopies
+	if job.pjlCopies > 0 {
+		copies = job.pjlCopies
+	}
+	if copies != ticketAttrs.Copies {
+		verdict.degrade("%s %d not supported, %d used", attributeCopies, ticketAttrs.Copies, copies)
+	}
+}
+
+func checkFinishings(verdict *ticketVerdict, ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) {
+	useFinishingsCol := finishingsColSupported(printerAttrs)
+
+	for _, finishing := range ticketAttrs.Finishings {
+		reqFinishingsEnum, ok := finishingsStringToEnumMap[finishing]
+		if !ok {
+			verdict.degrade("finishing %s unknown, ignored", finishing)
+			continue
+		}
+		reqFinishingsEnum = rotateFinishings(reqFinishingsEnum, ticketAttrs.OptionalPDLOverrides.Orientation)
+		generic, hasGeneric := genericFinishings[reqFinishingsEnum]
+
+		if useFinishingsCol {
+			if _, ok := supportedFinishingsCol(reqFinishingsEnum, printerAttrs.FinishingsColDatabase); ok {
+				continue
+			}
+			if hasGeneric {
+				if _, ok := supportedFinishingsCol(generic, printerAttrs.FinishingsColDatabase); ok {
+					verdict.degrade("finishing %s not supported, %s used", finishing, finishingTemplateNames[generic])
+					continue
+				}
+			}
+			verdict.degrade("finishing %s not supported, ignored", finishing)
+			continue
+		}
+
+		mapped, ok := getSupportedFinishingsEnum(reqFinishingsEnum, printerAttrs.FinishingsSupported)
+		if !ok {
+			verdict.degrade("finishing %s not supported, ignored", finishing)
+		} else if hasGeneric && mapped == int(generic) {
+			verdict.degrade("finishing %s not supported, %s used", finishing, finishingTemplateNames[generic])
+		}
+	}
+}
+
+func checkMedia(verdict *ticketVerdict, ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) {
+	selected := selectMedia(ticketAttrs, printerAttrs)
+
+	// The paper is only known once the document is inspected.
+	if ticketAttrs.PaperName != jobticket.PaperNameAuto {
+		requested, ok := lookupMediaSize(ticketAttrs.PaperName)
+		if !ok {
+			requested.Width, requested.Height = float64(ticketAttrs.PaperWidthMM*100), float64(ticketAttrs.PaperHeightMM*100)
+		}
+		if mediaSizeDistance(requested, selected) > mediaSizeTolerance {
+			verdict.degrade("paper %s not supported, %s used", ticketAttrs.PaperName, selected.Name)
+		}
+	}
+
+	if _, _, err := selectMediaSource(ticketAttrs, printerAttrs, selected, true); err != nil {
+		verdict.degrade("%v, the printer will prompt for it", unwrapOperationError(err))
+	}
+}
+
+func checkOptionalJobAttributes(verdict *ticketVerdict, ticketAttrs *jobticket.JobTicket, jobAttrs *ippclient.PrintJobTemplateAttributes) {
+	unsupported := func(attribute string, requested, sent bool) {
+		if requested && !sent {
+			verdict.degrade("%s not supported, ignored", attribute)
+		}
+	}
+	unsupported("page-ranges", ticketAttrs.PageRanges != "", len(jobAttrs.PageRanges) > 0)
+	unsupported("number-up", ticketAttrs.NumberUp > 0, jobAttrs.NumberUp > 0)
+	unsupported("print-quality", ticketAttrs.PrintQuality != "", jobAttrs.PrintQuality != 0)
+	unsupported("printer-resolution", ticketAttrs.PrinterResolution != "", jobAttrs.PrinterResolution.XRes != 0)
+	unsupported("output-bin", ticketAttrs.OutputBin != "", jobAttrs.OutputBin != "")
+	unsupported("print-scaling", ticketAttrs.PrintScaling != "", jobAttrs.PrintScaling != "")
+	unsupported("job-priority", ticketAttrs.JobPriority > 0, jobAttrs.JobPriority > 0)
+	unsupported("job-hold-until", ticketAttrs.JobHoldUntil != "", jobAttrs.JobHoldUntil != "")
+}
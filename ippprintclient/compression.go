@@ -0,0 +1,136 @@
+package ippprintclient
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// compression values, see RFC 8011 section 5.4.32.
+const (
+	compressionNone    = "none"
+	compressionAuto    = "auto" // The best compression the printer supports, see compressionPreference.
+	compressionGzip    = "gzip"
+	compressionDeflate = "deflate"
+)
+
+// Compressions the client can make, in order of preference.
+var compressionPreference = []string{compressionGzip, compressionDeflate}
+
+// Document formats that are already compressed, compressing them again costs time and saves nothing.
+var compressedDocumentFormats = []string{"image/jpeg", "image/png"}
+
+// selectCompression The compression to send the document with, compressionNone if it is sent as is. mode is
+// the -compression flag: none, auto, or a compression to use if the printer supports it.
+func selectCompression(printerAttrs *ippclient.PrinterAttributes, docFormat, mode string) string {
+	if mode == "" || mode == compressionNone || containsFold(compressedDocumentFormats, docFormat) {
+		return compressionNone
+	}
+
+	candidates := compressionPreference
+	if mode != compressionAuto {
+		candidates = []string{mode}
+	}
+	for _, compression := range candidates {
+		if containsFold(printerAttrs.CompressionSupported, compression) {
+			return compression
+		}
+	}
+	pclog.Devf("printer doesn't support %s compression, supported=%v", mode, printerAttrs.CompressionSupported)
+	return compressionNone
+}
+
+// compressedDocument A document compressed as it is read.
+type compressedDocument struct {
+	*io.PipeReader
+	compression string
+	done        chan struct{}
+	start       time.Time
+	elapsed     time.Duration
+	in, out     int64
+}
+
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	*w.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	*r.n += int64(n)
+	return n, err
+}
+
+// compressDocument Compress the document with gzip or deflate while it is read.
+func compressDocument(r io.Reader, compression string) *compressedDocument {
+	pr, pw := io.Pipe()
+	d := &compressedDocument{PipeReader: pr, compression: compression, done: make(chan struct{}), start: time.Now()}
+
+	go func() {
+		defer close(d.done)
+		out := countingWriter{Writer: pw, n: &d.out}
+
+		var w io.WriteCloser
+		if compression == compressionDeflate {
+			w, _ = flate.NewWriter(out, flate.DefaultCompression)
+		} else {
+			w = gzip.NewWriter(out)
+		}
+		_, err := io.Copy(w, countingReader{Reader: r, n: &d.in})
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		d.elapsed = time.Since(d.start)
+		pw.CloseWithError(err)
+	}()
+	return d
+}
+
+// Close Stop compressing. Waits for the compressing goroutine, so the counts are final.
+func (d *compressedDocument) Close() error {
+	err := d.PipeReader.Close()
+	<-d.done
+	return err
+}
+
+// report Record the compression ratio and time in the processing report. Call after Close.
+func (d *compressedDocument) report(operation string, attempt int) {
+	ratio := 0.0
+	if d.in > 0 {
+		ratio = float64(d.out) / float64(d.in) * 100
+	}
+	msg := fmt.Sprintf("compression %s: %d -> %d bytes (%.1f%%)", d.compression, d.in, d.out, ratio)
+	pclog.Supportf("%s in %v", msg, d.elapsed)
+	processingLogger.LogOperationAttempt(operation, attempt, msg, d.elapsed.String())
+}
+
+// document The document to send to the printer, compressed if the job is. finish must be called once the
+// operation returns.
+func (p *ippPrinter) document(file io.Reader, docFormat string) (*ippclient.Document, func(operation string, attempt int)) {
+	if p.compression == "" || p.compression == compressionNone {
+		return &ippclient.Document{Format: docFormat, Reader: file}, func(string, int) {}
+	}
+
+	compressed := compressDocument(file, p.compression)
+	return &ippclient.Document{Format: docFormat, Reader: compressed, Compression: p.compression},
+		func(operation string, attempt int) {
+			_ = compressed.Close()
+			compressed.report(operation, attempt)
+		}
+}
@@ -10,15 +10,47 @@ var printerReadyAttributes = []string{
 	ippclient.PrinterState,
 	ippclient.PrinterStateReasons,
 	ippclient.MediaColSupported,
+	ippclient.MediaSupported,
+	ippclient.MediaSizeSupported,
+	ippclient.MediaColReady,
+	ippclient.MediaReady,
+	ippclient.MediaSourceSupported,
 	ippclient.PrinterMakeAndModel,
 	ippclient.OperationsSupported,
 	ippclient.IppVersionsSupported,
 	ippclient.SidesSupported,
+	ippclient.PrintColorModeSupported,
 	ippclient.FinishingsSupported,
+	ippclient.FinishingsColSupported,
+	ippclient.FinishingsColDatabase,
+	ippclient.PageRangesSupported,
+	ippclient.NumberUpSupported,
+	ippclient.PrintQualitySupported,
+	ippclient.PrinterResolutionSupported,
+	ippclient.OutputBinSupported,
+	ippclient.PrintScalingSupported,
+	ippclient.JobPrioritySupported,
+	ippclient.JobHoldUntilSupported,
 	ippclient.CopiesSupported,
 	ippclient.DocumentFormatSupported,
 	ippclient.DocumentFormatDefault,
+	ippclient.PwgRasterDocumentResolutionSupported,
+	ippclient.PwgRasterDocumentTypeSupported,
+	ippclient.PwgRasterDocumentSheetBack,
+	ippclient.UrfSupported,
+	ippclient.CompressionSupported,
 	ippclient.PrinterDeviceId,
+	ippclient.PrinterFirmwareStringVersion,
+}
+
+// The volatile printer state, requested on its own when the cached printer capabilities are still fresh.
+// The loaded media is part of it, trays are refilled and swapped all the time.
+var printerStateAttributes = []string{
+	ippclient.PrinterIsAcceptingJobs,
+	ippclient.PrinterState,
+	ippclient.PrinterStateReasons,
+	ippclient.MediaColReady,
+	ippclient.MediaReady,
 }
 
 var finishingsStringToEnumMap = map[string]finishings.Finishings{
@@ -95,6 +127,84 @@ var finishingsStringToEnumMap = map[string]finishings.Finishings{
 	"fold-engineering-z": finishings.FinishingsFoldEngineeringZ,
 }
 
+// sheetPosition The edges and corners of the sheet finishings are placed at, in clockwise order.
+type sheetPosition int
+
+const (
+	positionTopLeft sheetPosition = iota
+	positionTop
+	positionTopRight
+	positionRight
+	positionBottomRight
+	positionBottom
+	positionBottomLeft
+	positionLeft
+	sheetPositions
+)
+
+// Finishings placed at a position on the sheet, grouped by family. Rotating the document moves them
+// to the position at the same place relative to the content, within the same family.
+var positionalFinishings = []map[sheetPosition]finishings.Finishings{
+	// Staple
+	{
+		positionTopLeft:     finishings.FinishingsStapleTopLeft,
+		positionBottomLeft:  finishings.FinishingsStapleBottomLeft,
+		positionTopRight:    finishings.FinishingsStapleTopRight,
+		positionBottomRight: finishings.FinishingsStapleBottomRight,
+	},
+	{
+		positionLeft:   finishings.FinishingsStapleDualLeft,
+		positionTop:    finishings.FinishingsStapleDualTop,
+		positionRight:  finishings.FinishingsStapleDualRight,
+		positionBottom: finishings.FinishingsStapleDualBottom,
+	},
+	{
+		positionLeft:   finishings.FinishingsStapleTripleLeft,
+		positionTop:    finishings.FinishingsStapleTripleTop,
+		positionRight:  finishings.FinishingsStapleTripleRight,
+		positionBottom: finishings.FinishingsStapleTripleBottom,
+	},
+	// Stitch
+	{
+		positionLeft:   finishings.FinishingsEdgeStitchLeft,
+		positionTop:    finishings.FinishingsEdgeStitchTop,
+		positionRight:  finishings.FinishingsEdgeStitchRight,
+		positionBottom: finishings.FinishingsEdgeStitchBottom,
+	},
+	// Bind
+	{
+		positionLeft:   finishings.FinishingsBindLeft,
+		positionTop:    finishings.FinishingsBindTop,
+		positionRight:  finishings.FinishingsBindRight,
+		positionBottom: finishings.FinishingsBindBottom,
+	},
+	// Punch
+	{
+		positionTopLeft:     finishings.FinishingsPunchTopLeft,
+		positionBottomLeft:  finishings.FinishingsPunchBottomLeft,
+		positionTopRight:    finishings.FinishingsPunchTopRight,
+		positionBottomRight: finishings.FinishingsPunchBottomRight,
+	},
+	{
+		positionLeft:   finishings.FinishingsPunchDualLeft,
+		positionTop:    finishings.FinishingsPunchDualTop,
+		positionRight:  finishings.FinishingsPunchDualRight,
+		positionBottom: finishings.FinishingsPunchDualBottom,
+	},
+	{
+		positionLeft:   finishings.FinishingsPunchTripleLeft,
+		positionTop:    finishings.FinishingsPunchTripleTop,
+		positionRight:  finishings.FinishingsPunchTripleRight,
+		positionBottom: finishings.FinishingsPunchTripleBottom,
+	},
+	{
+		positionLeft:   finishings.FinishingsPunchQuadLeft,
+		positionTop:    finishings.FinishingsPunchQuadTop,
+		positionRight:  finishings.FinishingsPunchQuadRight,
+		positionBottom: finishings.FinishingsPunchQuadBottom,
+	},
+}
+
 var genericFinishings = map[finishings.Finishings]finishings.Finishings{
 	// Staple
 	finishings.FinishingsStapleTopLeft:      finishings.FinishingsStaple,
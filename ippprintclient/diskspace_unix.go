@@ -0,0 +1,17 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package ippprintclient
+
+import (
+	"syscall"
+)
+
+// freeDiskSpace The bytes available to unprivileged users on the disk holding dir.
+func freeDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
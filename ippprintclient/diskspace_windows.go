@@ -0,0 +1,24 @@
+package ippprintclient
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeDiskSpace The bytes available to the user on the disk holding dir.
+func freeDiskSpace(dir string) (int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if r == 0 {
+		return 0, err
+	}
+	return int64(available), nil
+}
@@ -1,21 +1,317 @@
 package ippprintclient
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/filelock"
+)
+
+// Spool strategies, see -spoolStrategy.
+const (
+	spoolStrategyAuto   = "auto"   // In memory up to -spoolMemoryLimitMB, on disk above it.
+	spoolStrategyMemory = "memory" // In memory, larger documents fail with ErrPrintSpool.
+	spoolStrategyDisk   = "disk"   // On disk as it's read.
+	spoolStrategyStream = "stream" // Not spooled, the document is sent once and retries that resend it fail.
 )
 
+const megabyte = 1024 * 1024
+
+// Spool files are named spoolFilePrefix followed by a random suffix. Each is locked through a lock file with
+// spoolLockSuffix appended to its name for as long as it's in use, so the spool sweeper can tell it isn't orphaned.
+const (
+	spoolFilePrefix = "pcippclient-"
+	spoolLockSuffix = ".lock"
+)
+
+// errNotSpooled The document was streamed without spooling and can't be sent again.
+var errNotSpooled = errors.New("document not spooled, it can't be sent again")
+
+// spoolError The document couldn't be spooled, mapped to ErrPrintSpool.
+type spoolError struct {
+	msg string
+}
+
+func (e *spoolError) Error() string {
+	return e.msg
+}
+
+// spoolPolicy Where and how documents are spooled.
+type spoolPolicy struct {
+	strategy    string
+	memoryLimit int64 // Bytes
+	quota       int64 // Maximum bytes of a spool file, 0 for no limit
+	minFree     int64 // Bytes to leave free on the spool disk
+	encrypt     bool  // Encrypt spool files with a key only held in memory
+}
+
+func spoolPolicyFromFlags() *spoolPolicy {
+	return &spoolPolicy{
+		strategy:    *spoolStrategy,
+		memoryLimit: int64(*spoolMemoryLimitMB) * megabyte,
+		quota:       int64(*spoolQuotaMB) * megabyte,
+		minFree:     int64(*spoolMinFreeMB) * megabyte,
+		encrypt:     *spoolEncrypt,
+	}
+}
+
+// spoolDocument Spool the document as the spool flags say, so that it can be read again when an operation is retried.
+// size is the document size in bytes, -1 if it isn't known.
+// The returned cleanup function releases the spool, overwriting and removing a spool file.
+func spoolDocument(tmpDir string, r io.Reader, size int64) (readCloseResetter, func(), error) {
+	return spoolPolicyFromFlags().spool(tmpDir, r, size)
+}
+
+// documentSize The size of the document if it is a regular file, such as -ippPrintDoc or a file redirected to stdin,
+// -1 if it isn't known.
+func documentSize(file io.Reader) int64 {
+	if f, ok := file.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+func (p *spoolPolicy) spool(tmpDir string, r io.Reader, size int64) (readCloseResetter, func(), error) {
+	switch p.strategy {
+	case spoolStrategyStream:
+		return &unspooledReader{Reader: r}, func() {}, nil
+	case spoolStrategyDisk:
+		return p.spoolToDisk(tmpDir, r, size)
+	}
+
+	// Small documents are kept in memory.
+	prefix, err := ioutil.ReadAll(io.LimitReader(r, p.memoryLimit+1))
+	if err != nil {
+		return nil, nil, &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to read document: %v", err),
+		}
+	}
+	if int64(len(prefix)) <= p.memoryLimit {
+		return &memoryReader{bytes.NewReader(prefix)}, func() {}, nil
+	}
+	if p.strategy == spoolStrategyMemory {
+		return nil, nil, &OperationError{
+			Type: ErrPrintSpool,
+			Err:  fmt.Errorf("document larger than the %d byte spool memory limit", p.memoryLimit),
+		}
+	}
+	return p.spoolToDisk(tmpDir, io.MultiReader(bytes.NewReader(prefix), r), size)
+}
+
+// spoolToDisk Spool the document into a temporary file in tmpDir as it's read. Fails with ErrPrintSpool if the
+// disk is short of free space, the document is over the quota or the spool file can't be locked. A document of unknown size is spooled completely
+// before it's returned when there is a quota, so that it can't fail part way through being sent.
+func (p *spoolPolicy) spoolToDisk(tmpDir string, r io.Reader, size int64) (readCloseResetter, func(), error) {
+	if p.quota > 0 && size > p.quota {
+		return nil, nil, &OperationError{
+			Type: ErrPrintSpool,
+			Err:  fmt.Errorf("%d byte document larger than the %d byte spool quota", size, p.quota),
+		}
+	}
+
+	dir := tmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if free, err := freeDiskSpace(dir); err != nil {
+		pclog.Devf("failed to check free spool space: %v", err)
+	} else if free < p.minFree {
+		return nil, nil, &OperationError{
+			Type: ErrPrintSpool,
+			Err:  fmt.Errorf("%d bytes free in %s, less than the %d bytes required for spooling", free, dir, p.minFree),
+		}
+	}
+
+	tmpFile, err := os.CreateTemp(tmpDir, spoolFilePrefix+"*")
+	if err != nil {
+		return nil, nil, &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to create temporary file: %v", err),
+		}
+	}
+
+	spool := &spoolFile{file: tmpFile, quota: p.quota}
+	// Without the lock the spool sweeper of another process could remove the spool file while it's in use.
+	lock, ok, err := filelock.TryLock(tmpFile.Name() + spoolLockSuffix)
+	if err != nil || !ok {
+		spool.remove()
+		return nil, nil, &OperationError{
+			Type: ErrPrintSpool,
+			Err:  fmt.Errorf("failed to lock spool file: locked=%v err=%v", ok, err),
+		}
+	}
+	spool.lock = lock
+	if p.encrypt {
+		if err := spool.encrypt(); err != nil {
+			spool.remove()
+			return nil, nil, &OperationError{
+				Type: ErrPrintDefaultError,
+				Err:  fmt.Errorf("failed to set up spool encryption: %v", err),
+			}
+		}
+	}
+
+	if p.quota > 0 && size < 0 {
+		if _, err := io.Copy(spool, r); err != nil {
+			spool.remove()
+			if spool.err != nil {
+				return nil, nil, &OperationError{Type: ErrPrintSpool, Err: spool.err}
+			}
+			return nil, nil, &OperationError{
+				Type: ErrPrintDefaultError,
+				Err:  fmt.Errorf("failed to read document: %v", err),
+			}
+		}
+		docReader, err := (&fileReader{spool: spool}).Reset()
+		if err != nil {
+			spool.remove()
+			return nil, nil, &OperationError{
+				Type: ErrPrintDefaultError,
+				Err:  fmt.Errorf("failed to read document: %v", err),
+			}
+		}
+		return docReader, spool.remove, nil
+	}
+
+	return &streamReader{
+		ReadCloser: io.NopCloser(io.TeeReader(r, spool)),
+		spool:      spool,
+	}, spool.remove, nil
+}
+
+// spoolFailure The spool error that stopped the document being read, nil if there wasn't one.
+func spoolFailure(docReader readCloseResetter) error {
+	if s, ok := docReader.(*streamReader); ok && s.spool.err != nil {
+		return s.spool.err
+	}
+	return nil
+}
+
+// spoolFile A spool file, optionally encrypted with AES-CTR.
+type spoolFile struct {
+	file    *os.File
+	lock    *filelock.Lock
+	quota   int64
+	written int64
+	err     *spoolError
+
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+}
+
+func (f *spoolFile) encrypt() error {
+	key := make([]byte, 32)
+	f.iv = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(f.iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	f.block = block
+	f.stream = cipher.NewCTR(block, f.iv)
+	return nil
+}
+
+func (f *spoolFile) Write(b []byte) (int, error) {
+	if f.quota > 0 && f.written+int64(len(b)) > f.quota {
+		f.err = &spoolError{msg: fmt.Sprintf("document larger than the %d byte spool quota", f.quota)}
+		return 0, f.err
+	}
+
+	data := b
+	if f.stream != nil {
+		data = make([]byte, len(b))
+		f.stream.XORKeyStream(data, b)
+	}
+	n, err := f.file.Write(data)
+	f.written += int64(n)
+	return n, err
+}
+
+// reader Read the spooled document from the start.
+func (f *spoolFile) reader() (io.Reader, error) {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to reset reader: %v", err)
+	}
+	if f.block == nil {
+		return f.file, nil
+	}
+	return &cipher.StreamReader{S: cipher.NewCTR(f.block, f.iv), R: f.file}, nil
+}
+
+// remove Overwrite the spool file with zeros, then close and remove it along with its lock file.
+func (f *spoolFile) remove() {
+	overwriteFile(f.file, f.written)
+
+	err := f.file.Close()
+	if err != nil {
+		pclog.Devf("err=%v", err)
+	}
+
+	err = os.Remove(f.file.Name())
+	if err != nil {
+		pclog.Devf("failed to remove spoolfile: %v", err)
+	}
+
+	if f.lock != nil {
+		// Released first, an open lock file can't be removed on Windows.
+		if err := f.lock.Release(); err != nil {
+			pclog.Devf("failed to release spoolfile lock: %v", err)
+		}
+		_ = os.Remove(f.file.Name() + spoolLockSuffix)
+	}
+}
+
+// overwriteFile Overwrite the first size bytes of a file with zeros.
+func overwriteFile(file *os.File, size int64) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		pclog.Devf("failed to overwrite spoolfile: %v", err)
+		return
+	}
+
+	zeros := make([]byte, 64*1024)
+	for remaining := size; remaining > 0; {
+		n := int64(len(zeros))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := file.Write(zeros[:n]); err != nil {
+			pclog.Devf("failed to overwrite spoolfile: %v", err)
+			break
+		}
+		remaining -= n
+	}
+	_ = file.Sync()
+}
+
 type readCloseResetter interface {
 	io.ReadCloser
 	Reset() (readCloseResetter, error)
+	// Size The document size in bytes, -1 while it is still being spooled.
+	Size() int64
 }
 
 type streamReader struct {
 	io.ReadCloser
-	isRead  bool
-	tmpFile *os.File
+	isRead bool
+	spool  *spoolFile
 }
 
 func (s *streamReader) Read(b []byte) (int, error) {
@@ -23,6 +319,10 @@ func (s *streamReader) Read(b []byte) (int, error) {
 	return s.ReadCloser.Read(b)
 }
 
+func (s *streamReader) Size() int64 {
+	return -1
+}
+
 func (s *streamReader) Reset() (readCloseResetter, error) {
 	if !s.isRead {
 		return s, nil
@@ -32,22 +332,75 @@ func (s *streamReader) Reset() (readCloseResetter, error) {
 		return nil, fmt.Errorf("failed to read document: %v", err)
 	}
 
-	_, err = s.tmpFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("failed to reset reader: %v", err)
-	}
-	return &fileReader{s.tmpFile}, nil
+	return (&fileReader{spool: s.spool}).Reset()
 }
 
+// fileReader Reads a completely spooled document.
 type fileReader struct {
-	*os.File
+	io.Reader
+	spool *spoolFile
+}
+
+func (f *fileReader) Close() error {
+	return nil
+}
+
+func (f *fileReader) Size() int64 {
+	return f.spool.written
 }
 
 func (f *fileReader) Reset() (readCloseResetter, error) {
-	_, err := f.Seek(0, io.SeekStart)
+	r, err := f.spool.reader()
+	if err != nil {
+		return nil, err
+	}
+	f.Reader = r
+	return f, nil
+}
+
+// memoryReader Reads a document spooled in memory.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (m *memoryReader) Close() error {
+	return nil
+}
+
+func (m *memoryReader) Size() int64 {
+	return m.Reader.Size()
+}
+
+func (m *memoryReader) Reset() (readCloseResetter, error) {
+	_, err := m.Seek(0, io.SeekStart)
 	if err != nil {
 		return nil, fmt.Errorf("failed to reset reader: %v", err)
 	}
+	return m, nil
+}
 
-	return f, nil
+// unspooledReader Streams the document without spooling it. It can only be reset before it is read.
+type unspooledReader struct {
+	io.Reader
+	isRead bool
+}
+
+func (u *unspooledReader) Read(b []byte) (int, error) {
+	u.isRead = true
+	return u.Reader.Read(b)
+}
+
+func (u *unspooledReader) Close() error {
+	return nil
+}
+
+func (u *unspooledReader) Size() int64 {
+	return -1
+}
+
+func (u *unspooledReader) Reset() (readCloseResetter, error) {
+	if u.isRead {
+		return nil, errNotSpooled
+	}
+	return u, nil
 }
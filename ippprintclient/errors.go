@@ -1,6 +1,7 @@
 package ippprintclient
 
 import (
+	"errors"
 	"fmt"
 
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
@@ -44,10 +45,64 @@ func (e *ippJobOpError) As(target any) bool {
 
 type ippStatus int16
 
+// IPP status codes that call for special handling, see RFC 8011 section 4.1.6.
+const (
+	statusErrorDocumentFormatNotSupported     ippclient.Status = 0x040A
+	statusErrorAttributesOrValuesNotSupported ippclient.Status = 0x040B
+	statusErrorURISchemeNotSupported          ippclient.Status = 0x040C
+	statusErrorCompressionNotSupported        ippclient.Status = 0x040F
+	statusErrorDocumentAccessError            ippclient.Status = 0x0412
+	statusErrorOperationNotSupported          ippclient.Status = 0x0501
+)
+
 func (s ippStatus) Recoverable() bool {
 	return ippclient.Status(s) < ippclient.StatusErrorBadRequest || ippclient.Status(s) >= ippclient.StatusErrorInternal
 }
 
+// ippStatusError An IPP operation completed, but with an unsuccessful status code.
+type ippStatusError struct {
+	operation string
+	status    ippclient.Status
+	msg       string
+}
+
+func (e *ippStatusError) Error() string {
+	return e.msg
+}
+
+// retriesExhaustedError An operation kept failing with temporary errors until it ran out of attempts.
+type retriesExhaustedError struct {
+	operation string
+	attempts  int
+	err       error // The last failure
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("%s failed %d times: %v", e.operation, e.attempts, e.err)
+}
+
+func (e *retriesExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// invalidatesPrinterAttributes Whether the error means the printer attributes the job was built
+// from are wrong, e.g. stale cached attributes listing a document format the printer no longer supports.
+func invalidatesPrinterAttributes(err error) bool {
+	var statusErr *ippStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+
+	switch statusErr.status {
+	case statusErrorDocumentFormatNotSupported, statusErrorAttributesOrValuesNotSupported, statusErrorCompressionNotSupported:
+		return true
+	case statusErrorOperationNotSupported:
+		// Print-Job is sent whether or not the printer lists it, the other operations only when it does.
+		return statusErr.operation != printJobOperation
+	}
+	return false
+}
+
 // Operations specific error exit codes.
 // These exist codes are returned back to the caller, and are used to determine various failure scenarios.
 const (
@@ -63,6 +118,11 @@ const (
 	ErrPrintJobAborted                          int = 19
 	ErrPrintMonitorFailedToMonitor              int = 20 // Failed to monitor job with default IPP credentials
 	ErrPrintMonitorTerminatedBeforeJobFinalised int = 21
+	ErrPrintMediaNotReady                       int = 22 // No input tray holds the job's media and -mediaNotReady is fail
+	ErrPrintUnsupportedAttributes               int = 23 // The printer doesn't support the ticket's sides, color mode or copies and -capabilityMode is strict
+	ErrPrintDocFormatSniffMismatch              int = 24 // The document isn't in the ticket's format and -documentFormatMismatch is fail
+	ErrPrintUnauthorised                        int = 25 // The printer rejected the credentials before the document was sent
+	ErrPrintSpool                               int = 26 // The document couldn't be spooled: not enough free disk space, over the spool memory limit or quota, or the spool file couldn't be locked
 
 	// Check printer operation specific errors.
 	ErrCheckPrinter                 int = 30 // Default error for CheckPrinter operation
@@ -70,6 +130,26 @@ const (
 	ErrCheckPrinterErrorResponse    int = 32 // Printer responded with an error response
 	ErrCheckPrinterNetwork          int = 33 // Failed to reach printer. Network error.
 	ErrCheckPrinterDeviceIdMismatch int = 34 // Printer attributes printer-device-id don't match criteria
+
+	// Attribute cache command specific errors.
+	ErrAttributeCache         int = 40 // Default error for attribute-cache command
+	ErrAttributeCacheNotFound int = 41 // The printer is not in the cache
+	ErrAttributeCacheWarm     int = 42 // One or more printers couldn't be cached
+
+	// Validate ticket command specific errors.
+	ErrValidateTicket        int = 50 // Default error for validate-ticket command
+	ErrValidateTicketInvalid int = 51 // The ticket can't be read or has invalid fields
+
+	// Check ticket command specific errors.
+	ErrCheckTicket         int = 60 // Default error for check-ticket command, e.g. the printer attributes couldn't be fetched
+	ErrCheckTicketDegraded int = 61 // The job would print, but not as the ticket asks
+	ErrCheckTicketFail     int = 62 // The job would fail
+
+	// Cleanup spool command specific errors.
+	ErrCleanupSpool int = 70 // Default error for cleanup-spool command, e.g. the spool directory couldn't be read
+
+	// Command line errors.
+	ErrInvalidArgs int = 80 // A flag has a value it doesn't accept
 )
 
 // OperationError : Error type to be used in operations failure.
@@ -82,3 +162,7 @@ type OperationError struct {
 func (e *OperationError) Error() string {
 	return fmt.Sprintf("{ Type: %d, Args: %+v }", e.Type, e.Err)
 }
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,69 @@
+// Package filelock provides advisory, cross-process locks backed by lock files.
+// The locks are released by the OS when the owning process exits, so a crashed
+// process can never leave a lock held.
+package filelock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const lockFilePermission = 0644
+
+type Lock struct {
+	file *os.File
+}
+
+// TryLock Try to take an exclusive lock on the given path without blocking.
+// Returns false if another process (or another open handle) already holds the lock.
+func TryLock(path string) (*Lock, bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, lockFilePermission)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open lock file %v: %v", path, err)
+	}
+
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		_ = f.Close()
+		return nil, false, err
+	}
+
+	return &Lock{file: f}, true, nil
+}
+
+// Acquire Wait until an exclusive lock on the given path is taken, polling every pollInterval.
+// Returns the context error if the context is done before the lock could be taken.
+func Acquire(ctx context.Context, path string, pollInterval time.Duration) (*Lock, error) {
+	for {
+		l, ok, err := TryLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return l, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Release Release the lock. The lock file itself is left in place, removing it
+// would allow two processes to hold a lock on different inodes of the same path.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	closeErr := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,86 @@
+package ippprintclient
+
+import (
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3/finishings"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// finishing-template member of finishings-col, see PWG 5100.1.
+const finishingTemplate = "finishing-template"
+
+// finishingTemplateNames The finishing-template keyword of each finishings enum, the same keywords as the
+// ticket finishings.
+var finishingTemplateNames = func() map[finishings.Finishings]string {
+	names := make(map[finishings.Finishings]string, len(finishingsStringToEnumMap))
+	for name, enum := range finishingsStringToEnumMap {
+		names[enum] = name
+	}
+	// The ticket keyword is misspelt, the PWG keyword is jog-offset.
+	names[finishings.FinishingsJogOffset] = "jog-offset"
+	return names
+}()
+
+// finishingsColSupported Whether the printer takes finishings as finishings-col collections.
+func finishingsColSupported(printerAttrs *ippclient.PrinterAttributes) bool {
+	return containsFold(printerAttrs.FinishingsColSupported, finishingTemplate)
+}
+
+// mapFinishingsCol Translate the ticket finishings to finishings-col collections. Entries from the printer's
+// finishings-col-database are used as they are, they carry the stitching, punching and folding details the
+// printer expects. A finishing the database doesn't list falls back to its generic finishing. Printers without
+// a database get collections with just the finishing-template.
+func mapFinishingsCol(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) []map[string]interface{} {
+	var allFinishings []map[string]interface{}
+
+	for _, finishing := range ticketAttrs.Finishings {
+		reqFinishingsEnum, ok := finishingsStringToEnumMap[finishing]
+		if !ok {
+			pclog.Errorf("Requested finishing %s is not supported by the ippclient. Update the finishings.FinishingsMap", finishing)
+			continue
+		}
+		if reqFinishingsEnum == finishings.FinishingsNone {
+			continue
+		}
+		// Position of some finishing options change with orientation of document
+		reqFinishingsEnum = rotateFinishings(reqFinishingsEnum, ticketAttrs.OptionalPDLOverrides.Orientation)
+
+		if col, ok := supportedFinishingsCol(reqFinishingsEnum, printerAttrs.FinishingsColDatabase); ok {
+			allFinishings = append(allFinishings, col)
+			continue
+		}
+
+		if genericFinishingOption, ok := genericFinishings[reqFinishingsEnum]; ok {
+			if col, ok := supportedFinishingsCol(genericFinishingOption, printerAttrs.FinishingsColDatabase); ok {
+				pclog.Supportf("generic finishing-template for %s is supported by the printer. Falling back to %s",
+					finishingTemplateNames[reqFinishingsEnum], finishingTemplateNames[genericFinishingOption])
+				allFinishings = append(allFinishings, col)
+				continue
+			}
+		}
+
+		pclog.Supportf("Requested finishing-template %s is not supported by the printer, ignoring.", finishingTemplateNames[reqFinishingsEnum])
+	}
+
+	return allFinishings
+}
+
+// supportedFinishingsCol The finishings-col for a finishing, from the database if the printer has one.
+func supportedFinishingsCol(enum finishings.Finishings, database []map[string]interface{}) (map[string]interface{}, bool) {
+	name, ok := finishingTemplateNames[enum]
+	if !ok {
+		return nil, false
+	}
+
+	if len(database) == 0 {
+		return map[string]interface{}{finishingTemplate: name}, true
+	}
+
+	for _, col := range database {
+		if template, ok := col[finishingTemplate].(string); ok && template == name {
+			return col, true
+		}
+	}
+	return nil, false
+}
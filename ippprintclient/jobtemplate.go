@@ -0,0 +1,112 @@
+package ippprintclient
+
+import (
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ipp"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// printer-resolution units, see RFC 8011 section 5.1.16.
+var resolutionUnits = map[string]ipp.Units{
+	"dpi":  3,
+	"dpcm": 4,
+}
+
+// applyOptionalJobAttributes Map the ticket's optional job template attributes to the job, each only if the printer's
+// matching -supported attribute allows the ticket's value. The ticket is validated, so values parse.
+func applyOptionalJobAttributes(jobAttrs *ippclient.PrintJobTemplateAttributes, ticket *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) {
+	// Operation attributes, every printer takes them.
+	jobAttrs.JobName = ticket.JobName
+	jobAttrs.RequestingUserName = ticket.RequestingUserName
+
+	if pageRanges, _ := jobticket.ParsePageRanges(ticket.PageRanges); len(pageRanges) > 0 {
+		if printerAttrs.PageRangesSupported {
+			for _, pageRange := range pageRanges {
+				jobAttrs.PageRanges = append(jobAttrs.PageRanges, ipp.RangeOfInteger{LowerBound: pageRange.First, UpperBound: pageRange.Last})
+			}
+		} else {
+			logUnsupportedJobAttribute("page-ranges", ticket.PageRanges)
+		}
+	}
+
+	if ticket.NumberUp > 0 {
+		if containsInt(printerAttrs.NumberUpSupported, ticket.NumberUp) {
+			jobAttrs.NumberUp = ticket.NumberUp
+		} else {
+			logUnsupportedJobAttribute("number-up", ticket.NumberUp)
+		}
+	}
+
+	if quality, ok := jobticket.PrintQualities[ticket.PrintQuality]; ok {
+		if containsInt(printerAttrs.PrintQualitySupported, quality) {
+			jobAttrs.PrintQuality = quality
+		} else {
+			logUnsupportedJobAttribute("print-quality", ticket.PrintQuality)
+		}
+	}
+
+	if resolution, _ := jobticket.ParseResolution(ticket.PrinterResolution); resolution != nil {
+		ippResolution := ipp.Resolution{XRes: resolution.XRes, YRes: resolution.YRes, Units: resolutionUnits[resolution.Units]}
+		if containsResolution(printerAttrs.PrinterResolutionSupported, ippResolution) {
+			jobAttrs.PrinterResolution = ippResolution
+		} else {
+			logUnsupportedJobAttribute("printer-resolution", ticket.PrinterResolution)
+		}
+	}
+
+	if ticket.OutputBin != "" {
+		if containsFold(printerAttrs.OutputBinSupported, ticket.OutputBin) {
+			jobAttrs.OutputBin = ticket.OutputBin
+		} else {
+			logUnsupportedJobAttribute("output-bin", ticket.OutputBin)
+		}
+	}
+
+	if ticket.PrintScaling != "" {
+		if containsFold(printerAttrs.PrintScalingSupported, ticket.PrintScaling) {
+			jobAttrs.PrintScaling = ticket.PrintScaling
+		} else {
+			logUnsupportedJobAttribute("print-scaling", ticket.PrintScaling)
+		}
+	}
+
+	if ticket.JobPriority > 0 {
+		// job-priority-supported is the number of priority levels, any priority maps to one of them.
+		if printerAttrs.JobPrioritySupported > 0 {
+			jobAttrs.JobPriority = ticket.JobPriority
+		} else {
+			logUnsupportedJobAttribute("job-priority", ticket.JobPriority)
+		}
+	}
+
+	if ticket.JobHoldUntil != "" {
+		if containsFold(printerAttrs.JobHoldUntilSupported, ticket.JobHoldUntil) {
+			jobAttrs.JobHoldUntil = ticket.JobHoldUntil
+		} else {
+			logUnsupportedJobAttribute("job-hold-until", ticket.JobHoldUntil)
+		}
+	}
+}
+
+func logUnsupportedJobAttribute(attribute string, value interface{}) {
+	pclog.Supportf("%s %v is not supported by the printer, ignoring.", attribute, value)
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsResolution(values []ipp.Resolution, value ipp.Resolution) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+//go:build ignore
+
+// gen_schema writes the job ticket JSON Schema to jobticket.schema.json.
+package main
+
+import (
+	"log"
+	"os"
+
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+func main() {
+	schema, err := jobticket.Schema()
+	if err != nil {
+		log.Fatalf("failed to generate the job ticket schema: %v", err)
+	}
+
+	if err := os.WriteFile("jobticket.schema.json", append(schema, '\n'), 0644); err != nil {
+		log.Fatalf("failed to write the job ticket schema: %v", err)
+	}
+}
@@ -1,16 +1,34 @@
 package jobticket
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 type PDLOverrides struct {
 	Orientation OrientationType
+	PJLHeader   bool // Also send the job's duplex, orientation, color and copies in a PJL header, for PCL and PostScript documents.
 }
 
+// CurrentVersion The latest ticket schema version. Tickets without a version are version 1.
+const CurrentVersion = 1
+
+// PaperNameAuto Take the paper from the document's first page, PDF documents only. PaperWidthMM and PaperHeightMM
+// aren't needed. Other documents print on the default paper.
+const PaperNameAuto = "auto"
+
+//go:generate go run gen_schema.go
+
 type JobTicket struct {
+	Version              int // Ticket schema version, see CurrentVersion.
 	Copies               int
 	PrintColorMode       string
 	Sides                string
@@ -18,10 +36,25 @@ type JobTicket struct {
 	PaperName            string
 	PaperWidthMM         int
 	PaperHeightMM        int
-	OptionalPDLOverrides PDLOverrides // Specifies which PDL overrides to apply to the print job. E.g. orientation, duplex, etc. Note, this doesn't specify the actual values to apply.
+	MediaSource          string       // Optional input tray, e.g. tray-1. If empty, the tray holding the paper is picked.
+	MediaType            string       // Optional media type, e.g. stationery or labels.
+	OptionalPDLOverrides PDLOverrides // Specifies which PDL overrides to apply to the print job. E.g. orientation, duplex, etc. Note, this doesn't specify the actual values to apply. PDF documents fill in an empty orientation from their first page.
 	Credentials          Credentials
 	Finishings           []string
 	AltDocumentFormat    []string // Printer specific alternate document formats (overrides to spooled type if required).
+	EmulateCopiesFormats []string // Printer specific document formats for which the printer ignores copies, "*" for all. Copies are emulated by sending the document again.
+
+	// Optional job template attributes, only sent if the printer supports them.
+	PageRanges         string // e.g. 1-3,5
+	NumberUp           int
+	PrintQuality       string // draft, normal or high
+	PrinterResolution  string // e.g. 600dpi or 1200x600dpi
+	OutputBin          string
+	PrintScaling       string // auto, auto-fit, fill, fit or none
+	JobName            string
+	RequestingUserName string
+	JobPriority        int    // 1 to 100
+	JobHoldUntil       string // e.g. no-hold, indefinite or night
 }
 
 type Credentials struct {
@@ -30,36 +63,200 @@ type Credentials struct {
 }
 
 func (t *JobTicket) validate() error {
+	var problems []FieldError
+	invalid := func(field, format string, args ...interface{}) {
+		problems = append(problems, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t.Version < 0 || t.Version > CurrentVersion {
+		invalid("Version", "unsupported version %d, the latest supported version is %d", t.Version, CurrentVersion)
+	}
+
 	if t.PrintColorMode == "" {
-		return fmt.Errorf("invalid color mode")
+		invalid("PrintColorMode", "invalid color mode")
 	}
 
 	if t.Sides == "" {
-		return fmt.Errorf("invalid value for sides")
+		invalid("Sides", "invalid value for sides")
 	}
 
 	if t.Copies < 1 {
-		return fmt.Errorf("invalid number of copies")
+		invalid("Copies", "invalid number of copies")
 	}
 
-	if t.PaperName == "" || t.PaperHeightMM == 0 || t.PaperWidthMM == 0 {
-		return fmt.Errorf("invalid paper name, height or width values")
+	if t.PaperName == "" {
+		invalid("PaperName", "invalid paper name")
+	}
+	if t.PaperName != PaperNameAuto {
+		if t.PaperWidthMM <= 0 {
+			invalid("PaperWidthMM", "invalid paper width")
+		}
+		if t.PaperHeightMM <= 0 {
+			invalid("PaperHeightMM", "invalid paper height")
+		}
 	}
 
 	if t.DocumentFormat == "" {
-		return fmt.Errorf("invalid document format")
+		invalid("DocumentFormat", "invalid document format")
+	}
+
+	if _, err := ParsePageRanges(t.PageRanges); err != nil {
+		invalid("PageRanges", "%v", err)
+	}
+
+	if t.NumberUp < 0 {
+		invalid("NumberUp", "invalid number-up")
+	}
+
+	if t.PrintQuality != "" {
+		if _, ok := PrintQualities[t.PrintQuality]; !ok {
+			invalid("PrintQuality", "invalid print quality %q", t.PrintQuality)
+		}
+	}
+
+	if _, err := ParseResolution(t.PrinterResolution); err != nil {
+		invalid("PrinterResolution", "%v", err)
+	}
+
+	if t.PrintScaling != "" && !containsString(printScalings, t.PrintScaling) {
+		invalid("PrintScaling", "invalid print scaling %q", t.PrintScaling)
+	}
+
+	if t.JobPriority != 0 && (t.JobPriority < 1 || t.JobPriority > 100) {
+		invalid("JobPriority", "invalid job priority %d", t.JobPriority)
+	}
+
+	if t.JobHoldUntil != "" && !jobHoldUntilRegex.MatchString(t.JobHoldUntil) {
+		invalid("JobHoldUntil", "invalid job hold until %q", t.JobHoldUntil)
 	}
 
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
 	return nil
 }
 
+// FieldError A problem with one field of a ticket.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError Every problem found in a ticket.
+type ValidationError struct {
+	Problems []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		problems = append(problems, problem.Error())
+	}
+	return strings.Join(problems, "; ")
+}
+
+// PrintQualities print-quality enum values, see RFC 8011 section 5.2.13.
+var PrintQualities = map[string]int{
+	"draft":  3,
+	"normal": 4,
+	"high":   5,
+}
+
+var printScalings = []string{"auto", "auto-fit", "fill", "fit", "none"}
+
+// job-hold-until keywords, or names, are lower case words separated by dashes, e.g. second-shift.
+var jobHoldUntilRegex = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+var resolutionRegex = regexp.MustCompile(`^([0-9]+)(?:x([0-9]+))?(dpi|dpcm)$`)
+
+// PageRange An inclusive range of pages, starting at 1.
+type PageRange struct {
+	First int
+	Last  int
+}
+
+// ParsePageRanges Parse page ranges such as 1-3,5. The ranges must be ascending and not overlap.
+func ParsePageRanges(s string) ([]PageRange, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var ranges []PageRange
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page range %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid page range %q", part)
+			}
+		}
+		if first < 1 || last < first || (len(ranges) > 0 && first <= ranges[len(ranges)-1].Last) {
+			return nil, fmt.Errorf("invalid page range %q", part)
+		}
+		ranges = append(ranges, PageRange{First: first, Last: last})
+	}
+	return ranges, nil
+}
+
+// Resolution A printer resolution, XRes and YRes in Units, dpi or dpcm.
+type Resolution struct {
+	XRes  int
+	YRes  int
+	Units string
+}
+
+// ParseResolution Parse a resolution such as 600dpi or 1200x600dpi.
+func ParseResolution(s string) (*Resolution, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	match := resolutionRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if match == nil {
+		return nil, fmt.Errorf("invalid printer resolution %q", s)
+	}
+
+	xRes, _ := strconv.Atoi(match[1])
+	yRes := xRes
+	if match[2] != "" {
+		yRes, _ = strconv.Atoi(match[2])
+	}
+	if xRes == 0 || yRes == 0 {
+		return nil, fmt.Errorf("invalid printer resolution %q", s)
+	}
+
+	return &Resolution{XRes: xRes, YRes: yRes, Units: match[3]}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 type OrientationType string
 
 const (
-	OrientationPortrait  OrientationType = "portrait"
-	OrientationLandscape OrientationType = "landscape"
+	OrientationPortrait         OrientationType = "portrait"
+	OrientationLandscape        OrientationType = "landscape"
+	OrientationReverseLandscape OrientationType = "reverse-landscape"
+	OrientationReversePortrait  OrientationType = "reverse-portrait"
 )
 
+// read Read a JSON ticket, or a YAML ticket if the file is .yaml or .yml. Unknown fields are an error,
+// they're most likely misspelt.
 func read(path string) (*JobTicket, error) {
 
 	data, err := os.ReadFile(path)
@@ -67,15 +264,44 @@ func read(path string) (*JobTicket, error) {
 		return nil, err
 	}
 
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		return decodeYAML(data)
+	}
+	return decodeJSON(data)
+}
+
+func decodeJSON(data []byte) (*JobTicket, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
 	var ticket JobTicket
-	err = json.Unmarshal(data, &ticket)
-	if err != nil {
+	if err := decoder.Decode(&ticket); err != nil {
 		return nil, err
 	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the ticket")
+	}
 
 	return &ticket, nil
 }
 
+// decodeYAML YAML tickets use the same field names as JSON tickets, so they're converted to JSON and decoded
+// the same way.
+func decodeYAML(data []byte) (*JobTicket, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJSON(data)
+}
+
 func GetPrintJobAttributes(ticketPath string) (*JobTicket, error) {
 	jobTicket, err := read(ticketPath)
 	if err != nil {
@@ -83,7 +309,7 @@ func GetPrintJobAttributes(ticketPath string) (*JobTicket, error) {
 	}
 
 	if err := jobTicket.validate(); err != nil {
-		return nil, fmt.Errorf("invalid job ticket: %v", err)
+		return nil, fmt.Errorf("invalid job ticket: %w", err)
 	}
 
 	return jobTicket, nil
@@ -0,0 +1,99 @@
+package jobticket
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Constraints on ticket fields beyond their type, mirroring validate().
+var fieldSchemas = map[string]map[string]interface{}{
+	"Version":       {"minimum": 0, "maximum": CurrentVersion},
+	"Copies":        {"minimum": 1},
+	"PaperWidthMM":  {"minimum": 0},
+	"PaperHeightMM": {"minimum": 0},
+	"NumberUp":      {"minimum": 0},
+	"PrintQuality":  {"enum": []string{"draft", "normal", "high"}},
+	"PrintScaling":  {"enum": printScalings},
+	"JobPriority":   {"minimum": 0, "maximum": 100},
+	"JobHoldUntil":  {"pattern": jobHoldUntilRegex.String()},
+	"PageRanges":    {"pattern": `^\s*[0-9]+(\s*-\s*[0-9]+)?(\s*,\s*[0-9]+(\s*-\s*[0-9]+)?)*\s*$`},
+	"PrinterResolution": {
+		"pattern": resolutionRegex.String(),
+	},
+	"Orientation": {"enum": []OrientationType{
+		OrientationPortrait, OrientationLandscape, OrientationReverseLandscape, OrientationReversePortrait,
+	}},
+}
+
+// Fields validate() requires.
+var requiredFields = []string{
+	"Copies", "PrintColorMode", "Sides", "DocumentFormat", "PaperName",
+}
+
+// Fields validate() requires, at least 1, unless PaperName is PaperNameAuto.
+var paperSizeFields = []string{"PaperWidthMM", "PaperHeightMM"}
+
+// Schema The JSON Schema of the job ticket, generated from JobTicket. The published copy is
+// jobticket.schema.json, regenerate it with go generate when JobTicket changes.
+// The schema only accepts field names in their exact case, where ticket decoding, as Go's JSON decoding, ignores the
+// case, so a ticket the schema rejects for a field name like "copies" is still accepted by ipp-print-client.
+func Schema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(JobTicket{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Job ticket"
+	schema["description"] = "Field names are case-sensitive here, ipp-print-client also accepts them in any case. " +
+		"A Version of 0, or none, is version 1."
+	schema["required"] = requiredFields
+
+	paperSize := map[string]interface{}{}
+	for _, field := range paperSizeFields {
+		paperSize[field] = map[string]interface{}{"minimum": 1}
+	}
+	schema["if"] = map[string]interface{}{
+		"properties": map[string]interface{}{"PaperName": map[string]interface{}{"not": map[string]interface{}{"const": PaperNameAuto}}},
+	}
+	schema["then"] = map[string]interface{}{
+		"required":   paperSizeFields,
+		"properties": paperSize,
+	}
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{}, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			property := typeSchema(field.Type)
+			for key, value := range fieldSchemas[field.Name] {
+				property[key] = value
+			}
+			properties[field.Name] = property
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,140 @@
+package ippprintclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
+)
+
+// Which credentials a printer accepted, see printerattributecache.Behaviour.
+const (
+	credentialsNone    = "none"    // No credentials.
+	credentialsTicket  = "ticket"  // The job ticket's credentials.
+	credentialsDefault = "default" // defaultIppCredentials.
+)
+
+// learnedBehaviour What last worked sending a job to the printer, nil if nothing was learned or learning is off.
+// Behaviour learned from a different make and model or firmware version is forgotten, see LearnedBehaviour.
+func learnedBehaviour(attribCache *printerattributecache.PrinterAttributeCache, printerURI string, printerAttributes *ippclient.PrinterAttributes) *printerattributecache.Behaviour {
+	if attribCache == nil || !*learnPrinterBehaviour {
+		return nil
+	}
+
+	behaviour, err := attribCache.LearnedBehaviour(printerURI, printerAttributes)
+	if err != nil {
+		if !errors.Is(err, printerattributecache.ErrNotExist) && !errors.Is(err, printerattributecache.ErrCacheExpired) {
+			pclog.Devf("failed to read learned behaviour: %v", err)
+		}
+		return nil
+	}
+
+	msg := fmt.Sprintf("learned behaviour: %s with %s credentials, document format %s",
+		operationDescription(behaviour.Operation), behaviour.Credentials, behaviour.DocumentFormat)
+	pclog.Supportf(msg)
+	processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+	return behaviour
+}
+
+// rememberBehaviour Record what sent the job, so that the next job to the printer tries it first.
+func rememberBehaviour(attribCache *printerattributecache.PrinterAttributeCache, printerURI string, printer *ippPrinter, printerAttributes *ippclient.PrinterAttributes) {
+	if attribCache == nil || !*learnPrinterBehaviour || printer.operation == "" {
+		return
+	}
+
+	behaviour := printerattributecache.Behaviour{
+		Operation:      printer.operation,
+		Credentials:    credentialsPath(printer.Credentials),
+		DocumentFormat: printer.docFormat,
+	}
+	if err := attribCache.LearnBehaviour(printerURI, behaviour, printerAttributes); err != nil {
+		pclog.Devf("failed to record learned behaviour: %v", err)
+		return
+	}
+	pclog.Devf("learned behaviour for %v: %+v", printerURI, behaviour)
+}
+
+// forgetBehaviour Forget what was learned about the printer, e.g. when a job sent that way failed.
+func forgetBehaviour(attribCache *printerattributecache.PrinterAttributeCache, printerURI string) {
+	if err := attribCache.ForgetBehaviour(printerURI); err != nil {
+		pclog.Devf("failed to forget learned behaviour: %v", err)
+	}
+}
+
+// learnedCredentials The credentials to send the job with: the default credentials if the printer was learned
+// to accept them, unless the ticket has credentials of its own.
+func learnedCredentials(ticketCreds *ippclient.IPPCredentials, learned *printerattributecache.Behaviour) *ippclient.IPPCredentials {
+	if learned == nil || learned.Credentials != credentialsDefault {
+		return ticketCreds
+	}
+	if ticketCreds != nil && (ticketCreds.Username != defaultIppCredentials.Username || ticketCreds.Password != defaultIppCredentials.Password) {
+		return ticketCreds
+	}
+	return defaultIppCredentials
+}
+
+// usesLearnedCredentials Whether the printer is sending the job with the credentials it was learned to accept.
+func usesLearnedCredentials(p *ippPrinter) bool {
+	return p.learned != nil && p.learned.Credentials != "" && credentialsPath(p.Credentials) == p.learned.Credentials
+}
+
+// rejectedByPrinter Whether the job failed because the printer rejected it, with an IPP status or an HTTP 401,
+// rather than because the printer couldn't be reached or the document couldn't be spooled. Only a rejection
+// says anything about what was learned.
+func rejectedByPrinter(err error) bool {
+	var statusErr *ippStatusError
+	if errors.As(err, &statusErr) || invalidatesPrinterAttributes(err) {
+		return true
+	}
+	var opErr *OperationError
+	if errors.As(err, &opErr) && opErr.Type == ErrPrintUnauthorised {
+		return true
+	}
+	reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err)
+	return isHttpStatusError && reqErr != nil && reqErr.StatusCode == http.StatusUnauthorized
+}
+
+// preferLearnedOperation Move the learned operation to the front of the chain, if the chain has it.
+func preferLearnedOperation(chain []string, learned *printerattributecache.Behaviour) []string {
+	if learned == nil || len(chain) == 0 || chain[0] == learned.Operation {
+		return chain
+	}
+	for i, operation := range chain {
+		if operation == learned.Operation {
+			preferred := append([]string{operation}, chain[:i]...)
+			return append(preferred, chain[i+1:]...)
+		}
+	}
+	return chain
+}
+
+// preferLearnedDocumentFormat Prefer the learned document format among the ticket's alternate formats, if the
+// printer still supports it. The ticket's own format still comes first.
+func preferLearnedDocumentFormat(ticketAttrs *jobticket.JobTicket, printerAttributes *ippclient.PrinterAttributes, learned *printerattributecache.Behaviour) *jobticket.JobTicket {
+	if learned == nil || learned.DocumentFormat == "" || !containsFold(printerAttributes.DocumentFormatSupported, learned.DocumentFormat) {
+		return ticketAttrs
+	}
+	for _, format := range ticketAttrs.AltDocumentFormat {
+		if strings.TrimSpace(format) == learned.DocumentFormat {
+			preferred := *ticketAttrs
+			preferred.AltDocumentFormat = []string{format}
+			return &preferred
+		}
+	}
+	return ticketAttrs
+}
+
+func credentialsPath(credentials *ippclient.IPPCredentials) string {
+	switch {
+	case credentials == nil:
+		return credentialsNone
+	case credentials == defaultIppCredentials:
+		return credentialsDefault
+	}
+	return credentialsTicket
+}
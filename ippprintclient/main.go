@@ -7,11 +7,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"bitbucket.org/papercutsoftware/gopapercut/httputils"
 	"bitbucket.org/papercutsoftware/gopapercut/pclog"
 	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/util/config"
 )
 
 const (
@@ -20,6 +22,22 @@ const (
 	processingReportMarker       = "PROCESSING REPORT:"
 )
 
+// What to do when no input tray holds the job's media.
+const (
+	mediaNotReadyPrompt = "prompt" // Send the job anyway, the printer prompts for the media.
+	mediaNotReadyFail   = "fail"   // Fail the job with ErrPrintMediaNotReady.
+)
+
+// Printer capabilities rarely change, the printer state changes constantly.
+const (
+	defaultCacheCapabilitiesTTLSec = 24 * 60 * 60
+	defaultCacheStateTTLSec        = 30
+	defaultCacheMaxStaleSec        = 7 * 24 * 60 * 60
+	defaultCacheMaxEntries         = 1000
+	defaultCacheMaxSizeMB          = 100
+	defaultCacheGCIntervalSec      = 60 * 60
+)
+
 var (
 	ticketPath                              = flag.String("ticketPath", "", "job ticket path")
 	printerURI                              = flag.String("printerURI", "", "printer uri")
@@ -31,16 +49,40 @@ var (
 	httpConnectTimeoutSec                   = flag.Int("httpConnectTimeoutSec", 0, "http client connect timeout. If 0, Default TransportOptions from httputils will be used")
 	httpResponseHeaderTimeoutSec            = flag.Int("httpResponseHeaderTimeoutSec", 0, "http client response header timeout. If 0, Default TransportOptions from httputils will be used")
 	httpTlsHandshakeTimeoutSec              = flag.Int("httpTlsHandshakeTimeoutSec", 0, "http client tls handshake timeout. If 0, Default TransportOptions from httputils will be used")
-	ippPrintOperation                       = flag.String("ippPrintOperation", "", "preferred ipp print operation")
+	ippPrintOperation                       = flag.String("ippPrintOperation", "", "preferred ipp print operation, print-job is the same as -ippOperationChain print-job")
+	ippOperationChain                       = flag.String("ippOperationChain", "create-job,print-job", "ipp operations to send jobs with, in order of preference: create-job, print-job, send-uri, print-uri")
+	ippDocumentServerAddress                = flag.String("ippDocumentServerAddress", "", "address the printer fetches send-uri and print-uri documents from")
+	ippDocumentFetchTimeoutSec              = flag.Int("ippDocumentFetchTimeoutSec", 0, "seconds the printer has to fetch a send-uri or print-uri document before the next operation is tried. 0 for the upload timeout of the document")
+	ippAuthProbe                            = flag.Bool("ippAuthProbe", true, "settle credentials with a Validate-Job or Get-Printer-Attributes before sending a Print-Job document")
 	ippMaxUnauthorisedAttempts              = flag.Int("ippMaxUnauthorisedAttempts", 4, "maximum attempts to print when a printer returns unauthorised response (default matches iOS CUPS implementation)")
 	maxCreateJobAttempts                    = flag.Int("maxCreateJobAttempts", 3, "maximum attempts to create a valid job")
 	ippPrintDoc                             = flag.String("ippPrintDoc", "", "path to file to be printed, if not specified, stdin is used")
 	printerAttributeCacheEnabled            = flag.Bool("printerAttributeCacheEnabled", false, "enable the printer attributes cache")
 	printerAttributeCachePath               = flag.String("printerAttributeCachePath", "", "Path to printer attributes cache directory")
+	printerAttributeCacheCapabilitiesTTLSec = flag.Int("printerAttributeCacheCapabilitiesTTLSec", defaultCacheCapabilitiesTTLSec, "time to live of cached printer capabilities")
+	printerAttributeCacheStateTTLSec        = flag.Int("printerAttributeCacheStateTTLSec", defaultCacheStateTTLSec, "time to live of cached printer state")
+	printerAttributeCacheMaxStaleSec        = flag.Int("printerAttributeCacheMaxStaleSec", defaultCacheMaxStaleSec, "how long past their time to live cached capabilities are used while refreshed in the background. 0 disables it")
+	printerAttributeCacheMaxEntries         = flag.Int("printerAttributeCacheMaxEntries", defaultCacheMaxEntries, "maximum number of printers in the attribute cache. 0 means no limit")
+	printerAttributeCacheMaxSizeMB          = flag.Int("printerAttributeCacheMaxSizeMB", defaultCacheMaxSizeMB, "maximum size of the attribute cache in MB. 0 means no limit")
+	printerAttributeCacheGCIntervalSec      = flag.Int("printerAttributeCacheGCIntervalSec", defaultCacheGCIntervalSec, "minimum time between attribute cache garbage collections")
+	learnPrinterBehaviour                   = flag.Bool("learnPrinterBehaviour", true, "remember per printer, in the attribute cache, the operation, credentials and document format that last worked and try them first")
 	ippCommandTimeoutSec                    = flag.Int("ippCommandTimeout", defaultIPPCommandTimoutSec, "Total time to finish the ipp command")
 	ippGetAttributeRetries                  = flag.Int("ippGetAttributeRetries", 5, "max number of retries for get-attributes operations")
 	ippDeviceId                             = flag.String("ippDeviceId", "", "ipp device id raw value")
 	ippDeviceIdSnRegex                      = flag.String("ippDeviceIdSnRegex", "", "ipp device id serial number reg exp")
+	mediaNotReady                           = flag.String("mediaNotReady", mediaNotReadyPrompt, "what to do when no input tray holds the job's media: prompt or fail")
+	documentFormatMismatch                  = flag.String("documentFormatMismatch", documentFormatMismatchWarn, "what to do when the document isn't in the ticket's document format: warn or fail")
+	uploadMinThroughputKBps                 = flag.Int("uploadMinThroughputKBps", 8, "minimum document upload throughput in KB/s, uploads get the http request timeout plus the time to send the document at this rate. 0 for no upload timeout")
+	uploadProgressIntervalSec               = flag.Int("uploadProgressIntervalSec", 10, "seconds between document upload progress reports, 0 for none")
+	spoolStrategy                           = flag.String("spoolStrategy", spoolStrategyAuto, "how documents are spooled for retries: auto, memory, disk or stream")
+	spoolMemoryLimitMB                      = flag.Int("spoolMemoryLimitMB", 8, "largest document spooled in memory")
+	spoolQuotaMB                            = flag.Int("spoolQuotaMB", 0, "largest document spooled to disk, 0 for no limit")
+	spoolMinFreeMB                          = flag.Int("spoolMinFreeMB", 64, "free disk space required to spool a document to disk")
+	spoolEncrypt                            = flag.Bool("spoolEncrypt", false, "encrypt spool files with a key only held in memory")
+	spoolSweepOnStart                       = flag.Bool("spoolSweepOnStart", true, "remove orphaned spool files before spooling a document")
+	spoolSweepAgeSec                        = flag.Int("spoolSweepAgeSec", 3600, "age after which an unlocked spool file is orphaned")
+	compression                             = flag.String("compression", compressionNone, "compress documents sent to printers that support it: none, auto, gzip or deflate")
+	capabilityMode                          = flag.String("capabilityMode", capabilityModeBestEffort, "what to do with ticket attributes the printer doesn't support: best-effort (downgrade them) or strict (fail)")
 )
 
 // General Exit codes returned by this executable
@@ -54,7 +96,7 @@ var (
 func usage() {
 	exeName := filepath.Base(os.Args[0])
 	_, _ = fmt.Fprintf(os.Stdout,
-		`usage: %s [flags] [check-printer|print-job]
+		`usage: %s [flags] [check-printer|print-job|check-ticket|attribute-cache|validate-ticket|cleanup-spool]
 	where [flags]:
 		-ticketPath - path to job ticket
 		-printerURI - printer uri
@@ -66,9 +108,53 @@ func usage() {
 		-httpTlsHandshakeTimeoutSec - http client tls handshake timeout
 		-printerAttributeCacheEnabled - enable the printer attributes cache
 		-printerAttributeCachePath - printer attributes cache will use this directory to store cache files
+		-printerAttributeCacheCapabilitiesTTLSec - time to live of cached printer capabilities
+		-printerAttributeCacheStateTTLSec - time to live of cached printer state
+		-printerAttributeCacheMaxStaleSec - how long stale cached capabilities are used while refreshed in the background
+		-printerAttributeCacheMaxEntries - maximum number of printers in the attribute cache
+		-printerAttributeCacheMaxSizeMB - maximum size of the attribute cache in MB
+		-printerAttributeCacheGCIntervalSec - minimum time between attribute cache garbage collections
+		-learnPrinterBehaviour - remember per printer, next to its cached attributes, the operation, credentials and document format that last worked and try them first. Forgotten when a job sent that way fails or the printer's make and model or firmware changes
 		-ippCommandTimeout - total time to finish the ipp command
 		-ippDeviceId - ipp device id raw value
 		-ippDeviceIdSnRegex - ipp device id serial number reg exp
+		-mediaNotReady - what to do when no input tray holds the job's media: prompt (the printer asks for it) or fail
+		-documentFormatMismatch - what to do when the document isn't in the ticket's document format: warn or fail
+		-capabilityMode - what to do with ticket sides, color mode or copies the printer doesn't support: best-effort (downgrade) or strict (fail)
+		-uploadMinThroughputKBps - minimum document upload throughput, uploads get -httpRequestTimeoutSec plus the time to send the document at this rate
+		-uploadProgressIntervalSec - seconds between document upload progress reports in the processing report
+		-ippOperationChain - ipp operations to send jobs with, in order of preference: create-job (Create-Job and Send-Document), print-job, send-uri (Create-Job and Send-URI) or print-uri. Operations the printer doesn't list are skipped, the next one is tried when the printer rejects one as unsupported
+		-ippDocumentServerAddress - host:port the printer fetches send-uri and print-uri documents from, defaults to a random port of the local address facing the printer
+		-ippDocumentFetchTimeoutSec - seconds the printer has to fetch a send-uri or print-uri document before the next operation is tried, defaults to the upload timeout of the document
+		-ippAuthProbe - settle credentials before sending a Print-Job document, so an HTTP 401 doesn't cost a whole upload
+		-spoolStrategy - how documents are spooled for retries: auto (memory up to -spoolMemoryLimitMB, then disk), memory, disk or stream (no spooling, no resends)
+		-spoolMemoryLimitMB - largest document spooled in memory
+		-spoolQuotaMB - largest document spooled to disk, 0 for no limit. Documents of unknown size are spooled completely before they are sent
+		-spoolMinFreeMB - free disk space required to spool a document to disk
+		-spoolEncrypt - encrypt spool files with a key only held in memory
+		-spoolSweepOnStart - remove orphaned spool files, left by a process that crashed or was killed, before spooling a document
+		-spoolSweepAgeSec - age after which a spool file no live process holds the lock of is orphaned
+		-compression - compress documents sent to printers that support it: none, auto (gzip or deflate), gzip or deflate
+
+	usage (attribute cache): %s -printerAttributeCachePath [path] [flags] attribute-cache [list|show|purge|warm|export|import]
+		list - list the cached printers: uri, age, make and model
+		show [uri] - print the cached attributes of a printer and what was learned about sending jobs to it
+		purge [-expired|-uri [uri]] - remove expired entries, one printer, or everything
+		warm [uri]... - fetch and cache the attributes of the printers, - reads uris from stdin
+		export [file] - write the cache entries to file, or stdout
+		import [file] - read cache entries written by export from file, or stdin
+
+	usage (check ticket): %s -ticketPath [path] -printerURI [uri] check-ticket
+		checks whether the ticket would print as requested on the printer, without creating a job.
+		prints pass, degraded or fail with the reasons
+
+	usage (validate ticket): %s -ticketPath [path] validate-ticket [-schema]
+		checks a JSON or YAML job ticket without a printer and lists every problem found
+		-schema - print the job ticket JSON Schema instead
+
+	usage (cleanup spool): %s [flags] cleanup-spool [-maxAgeSec [seconds]]
+		removes orphaned spool files no live process holds the lock of and reports the space reclaimed
+		-maxAgeSec - only remove spool files older than this, defaults to -spoolSweepAgeSec
 
 	usage (test mode): %s -test -op [operation] -uri[printer uri]|-address[printer address] [flags]
 	where [operation]: \get-printer-attributes\|\print-job\|\cups-get-printers\|\get-job-attributes\
@@ -77,7 +163,7 @@ func usage() {
 		-stdin - StandardIn - file input method
 		-path - Path - file input method
 		-media-size - paper size
-		-document-format - format of the document provided (application/pdf, application/postscript, image/urf)`+"\n", exeName, exeName)
+		-document-format - format of the document provided (application/pdf, application/postscript, image/urf)`+"\n", exeName, exeName, exeName, exeName, exeName, exeName)
 	os.Exit(ExitCodeHelp)
 }
 
@@ -97,6 +183,11 @@ func Main() {
 		os.Exit(ExitCodeSuccess)
 	}
 
+	if err := validateFlags(); err != nil {
+		pclog.Errorf("%v", err)
+		os.Exit(ErrInvalidArgs)
+	}
+
 	//setting up processing logger
 	processingLogger = &ippclientProcessingLogger{
 		output: os.Stderr,
@@ -145,8 +236,9 @@ func Main() {
 
 	var printerAttributeCache *printerattributecache.PrinterAttributeCache = nil
 
-	if *printerAttributeCacheEnabled && *printerAttributeCachePath != "" {
-		printerAttributeCache, err = printerattributecache.NewCache(30, *printerAttributeCachePath)
+	// The attribute-cache command works on the cache whether or not printing uses it.
+	if (*printerAttributeCacheEnabled || cmd == "attribute-cache") && *printerAttributeCachePath != "" {
+		printerAttributeCache, err = newPrinterAttributeCache(*printerAttributeCachePath)
 		// If we failed to initialise the cache, still continue without it, don't fail printing.
 		if err != nil {
 			pclog.Errorf(err.Error())
@@ -166,10 +258,14 @@ func Main() {
 		pclog.Supportf("ippDeviceIdSnRegex: %v", *ippDeviceIdSnRegex)
 		err = checkPrinter(*printerURI, httpClient, printerAttributeCache, *ippDeviceId, *ippDeviceIdSnRegex)
 	case "print-job":
+		if *spoolSweepOnStart {
+			sweepSpoolOnStart()
+		}
 		if *ippPrintDoc != "" {
 			f, openErr := os.Open(*ippPrintDoc)
 			if openErr != nil {
 				pclog.Errorf("cannot open input file %v", openErr)
+				printerAttributeCache.Wait()
 				os.Exit(1)
 			}
 			defer func() { _ = f.Close() }()
@@ -177,10 +273,21 @@ func Main() {
 		} else {
 			err = printJob(*ticketPath, *printerURI, os.Stdin, httpClient, printerAttributeCache, time.Duration(*ippCommandTimeoutSec)*time.Second)
 		}
+	case "attribute-cache":
+		err = attributeCacheCommand(flag.Args()[1:], printerAttributeCache, httpClient)
+	case "check-ticket":
+		err = checkTicketCommand(os.Stdout, *ticketPath, *printerURI, httpClient, printerAttributeCache)
+	case "validate-ticket":
+		err = validateTicketCommand(os.Stdout, flag.Args()[1:], *ticketPath)
+	case "cleanup-spool":
+		err = cleanupSpoolCommand(os.Stdout, flag.Args()[1:], config.TmpDir)
 	default:
 		flag.PrintDefaults()
 	}
 
+	// os.Exit doesn't wait for goroutines, let the cache's background refreshes and garbage collection finish.
+	printerAttributeCache.Wait()
+
 	if err != nil {
 		pclog.Errorf("ipp command:%v failed: %v", cmd, err)
 
@@ -194,3 +301,50 @@ func Main() {
 		processingLogger.LogOperationAttempt(cmd, 1, "command execution success", time.Since(startTime).String())
 	}
 }
+
+// validateFlags Check the flags taking one of a set of values, so that a misspelt value fails at start-up rather
+// than quietly meaning the default. Returns an OperationError with ErrInvalidArgs.
+func validateFlags() error {
+	enums := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"spoolStrategy", *spoolStrategy, []string{spoolStrategyAuto, spoolStrategyMemory, spoolStrategyDisk, spoolStrategyStream}},
+		{"compression", *compression, []string{compressionNone, compressionAuto, compressionGzip, compressionDeflate}},
+		{"capabilityMode", *capabilityMode, []string{capabilityModeBestEffort, capabilityModeStrict}},
+		{"mediaNotReady", *mediaNotReady, []string{mediaNotReadyPrompt, mediaNotReadyFail}},
+		{"documentFormatMismatch", *documentFormatMismatch, []string{documentFormatMismatchWarn, documentFormatMismatchFail}},
+	}
+	for _, enum := range enums {
+		valid := false
+		for _, allowed := range enum.allowed {
+			valid = valid || enum.value == allowed
+		}
+		if !valid {
+			return &OperationError{
+				Type: ErrInvalidArgs,
+				Err:  fmt.Errorf("invalid -%s %q, expected one of %s", enum.name, enum.value, strings.Join(enum.allowed, ", ")),
+			}
+		}
+	}
+	return nil
+}
+
+func newPrinterAttributeCache(path string) (*printerattributecache.PrinterAttributeCache, error) {
+	cache, err := printerattributecache.NewCacheWithExpiry(printerattributecache.Expiry{
+		Capabilities: time.Duration(*printerAttributeCacheCapabilitiesTTLSec) * time.Second,
+		State:        time.Duration(*printerAttributeCacheStateTTLSec) * time.Second,
+		MaxStale:     time.Duration(*printerAttributeCacheMaxStaleSec) * time.Second,
+	}, path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.SetLimits(printerattributecache.Limits{
+		MaxEntries: *printerAttributeCacheMaxEntries,
+		MaxSize:    int64(*printerAttributeCacheMaxSizeMB) * 1024 * 1024,
+	})
+	cache.CollectGarbageInBackground(time.Duration(*printerAttributeCacheGCIntervalSec) * time.Second)
+	return cache, nil
+}
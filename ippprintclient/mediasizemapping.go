@@ -1,9 +1,26 @@
 package ippprintclient
 
-import "bitbucket.org/papercutsoftware/ipp/v2"
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/ipp/v2"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
 
 var defaultIppMediaSize = ipp.MediaTypeIsoA4
 
+// Sizes closer than this, in hundredths of a millimetre, are treated as the same size.
+const mediaSizeTolerance = 200
+
+// A PWG 5101.1 self-describing media name, e.g. iso_a4_210x297mm or na_letter_8.5x11in.
+var pwgMediaNameRegex = regexp.MustCompile(`^([a-z0-9]+)_([a-z0-9.\-]*)_([0-9]+(?:\.[0-9]+)?)x([0-9]+(?:\.[0-9]+)?)(mm|in)$`)
+
 var ippMediaSizeMap = map[string]ipp.MediaType{
 	"5x7":       ipp.MediaTypeNa5X7,
 	"8x10":      ipp.MediaTypeNa8X10,
@@ -51,9 +68,195 @@ var ippMediaSizeMap = map[string]ipp.MediaType{
 	"B10": ipp.MediaTypeJisB10,
 }
 
-func getIppMediaSizeFromName(name string) ipp.MediaType {
-	if val, ok := ippMediaSizeMap[name]; ok {
-		return val
+var ippMediaSizeMapLower = func() map[string]ipp.MediaType {
+	m := make(map[string]ipp.MediaType, len(ippMediaSizeMap))
+	for name, size := range ippMediaSizeMap {
+		m[strings.ToLower(name)] = size
+	}
+	return m
+}()
+
+// parsePWGMediaName Parse a PWG self-describing media name. Dimensions are returned in hundredths of a millimetre.
+func parsePWGMediaName(name string) (ipp.MediaType, bool) {
+	match := pwgMediaNameRegex.FindStringSubmatch(strings.ToLower(strings.TrimSpace(name)))
+	if match == nil {
+		return ipp.MediaType{}, false
+	}
+
+	width, err := strconv.ParseFloat(match[3], 64)
+	if err != nil {
+		return ipp.MediaType{}, false
+	}
+	height, err := strconv.ParseFloat(match[4], 64)
+	if err != nil {
+		return ipp.MediaType{}, false
+	}
+
+	unit := 100.0
+	if match[5] == "in" {
+		unit = 2540
+	}
+
+	return ipp.MediaType{
+		Name:   match[0],
+		Width:  math.Round(width * unit),
+		Height: math.Round(height * unit),
+	}, true
+}
+
+// lookupMediaSize Find the media size for a ticket paper name, either a PWG self-describing name or one of
+// the legacy names in ippMediaSizeMap, ignoring case.
+func lookupMediaSize(name string) (ipp.MediaType, bool) {
+	if size, ok := parsePWGMediaName(name); ok {
+		return size, true
+	}
+	if size, ok := ippMediaSizeMapLower[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return size, true
 	}
-	return defaultIppMediaSize
+	return ipp.MediaType{}, false
+}
+
+// customMediaName Build a PWG custom media name, e.g. custom_receipt_80x200mm. Without a name the
+// dimensions name the size too, e.g. custom_80x200mm_80x200mm, PWG 5101.1 doesn't allow an empty name.
+func customMediaName(name string, width, height float64) string {
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.TrimSpace(name)))
+
+	dimensions := fmt.Sprintf("%sx%smm", strconv.FormatFloat(width/100, 'f', -1, 64), strconv.FormatFloat(height/100, 'f', -1, 64))
+	if name == "" {
+		name = dimensions
+	}
+	return fmt.Sprintf("custom_%s_%s", name, dimensions)
+}
+
+// mediaSizeDistance How far apart two sizes are, ignoring orientation.
+func mediaSizeDistance(a, b ipp.MediaType) float64 {
+	aShort, aLong := math.Min(a.Width, a.Height), math.Max(a.Width, a.Height)
+	bShort, bLong := math.Min(b.Width, b.Height), math.Max(b.Width, b.Height)
+	return math.Abs(aShort-bShort) + math.Abs(aLong-bLong)
+}
+
+// supportedMediaSizes The discrete sizes a printer advertises in media-supported and media-size-supported.
+func supportedMediaSizes(printerAttrs *ippclient.PrinterAttributes) []ipp.MediaType {
+	var sizes []ipp.MediaType
+	for _, name := range printerAttrs.MediaSupported {
+		if size, ok := parsePWGMediaName(name); ok {
+			size.Name = name
+			sizes = append(sizes, size)
+		}
+	}
+	for _, mediaSize := range printerAttrs.MediaSizeSupported {
+		if mediaSize.XDimension.LowerBound != mediaSize.XDimension.UpperBound ||
+			mediaSize.YDimension.LowerBound != mediaSize.YDimension.UpperBound {
+			continue
+		}
+		width, height := float64(mediaSize.XDimension.LowerBound), float64(mediaSize.YDimension.LowerBound)
+		sizes = append(sizes, ipp.MediaType{Name: customMediaName("", width, height), Width: width, Height: height})
+	}
+	return sizes
+}
+
+// customMediaSizeSupported Whether a size falls within one of the custom size ranges in media-size-supported.
+func customMediaSizeSupported(size ipp.MediaType, printerAttrs *ippclient.PrinterAttributes) bool {
+	within := func(v float64, lower, upper int) bool {
+		return v >= float64(lower) && v <= float64(upper)
+	}
+	for _, mediaSize := range printerAttrs.MediaSizeSupported {
+		if mediaSize.XDimension.LowerBound == mediaSize.XDimension.UpperBound &&
+			mediaSize.YDimension.LowerBound == mediaSize.YDimension.UpperBound {
+			continue
+		}
+		if within(size.Width, mediaSize.XDimension.LowerBound, mediaSize.XDimension.UpperBound) &&
+			within(size.Height, mediaSize.YDimension.LowerBound, mediaSize.YDimension.UpperBound) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectMedia Select the media for a job. The ticket's paper name is matched against the printer's supported
+// sizes, falling back to the ticket's dimensions if the name isn't recognised. Sizes the printer doesn't list
+// are sent as custom media if they fit its custom size ranges, otherwise the nearest listed size is used.
+func selectMedia(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) ipp.MediaType {
+	requested, ok := lookupMediaSize(ticketAttrs.PaperName)
+	if !ok {
+		if ticketAttrs.PaperWidthMM <= 0 || ticketAttrs.PaperHeightMM <= 0 {
+			pclog.Supportf("unknown paper %q with no dimensions, using %v", ticketAttrs.PaperName, defaultIppMediaSize.Name)
+			return defaultIppMediaSize
+		}
+		width, height := float64(ticketAttrs.PaperWidthMM*100), float64(ticketAttrs.PaperHeightMM*100)
+		requested = ipp.MediaType{Name: customMediaName(ticketAttrs.PaperName, width, height), Width: width, Height: height}
+	}
+
+	supported := supportedMediaSizes(printerAttrs)
+	if len(supported) == 0 && len(printerAttrs.MediaSizeSupported) == 0 {
+		// The printer doesn't say what it supports, so send what was asked for.
+		return requested
+	}
+
+	var nearest ipp.MediaType
+	nearestDistance := math.Inf(1)
+	for _, size := range supported {
+		distance := mediaSizeDistance(requested, size)
+		if distance <= mediaSizeTolerance {
+			return size
+		}
+		if distance < nearestDistance {
+			nearest, nearestDistance = size, distance
+		}
+	}
+
+	if customMediaSizeSupported(requested, printerAttrs) {
+		requested.Name = customMediaName(ticketAttrs.PaperName, requested.Width, requested.Height)
+		return requested
+	}
+
+	if len(supported) == 0 {
+		return requested
+	}
+
+	pclog.Supportf("paper %q (%vx%v) not supported by printer, downgrading to nearest size %v",
+		ticketAttrs.PaperName, requested.Width, requested.Height, nearest.Name)
+	return nearest
+}
+
+// jobMediaSize The media size of a built job template, in hundredths of a millimetre, from media-col if it
+// was sent, otherwise from the media name.
+func jobMediaSize(jobAttrs *ippclient.PrintJobTemplateAttributes) (int, int) {
+	if mediaSize, ok := jobAttrs.MediaCol["media-size"].(map[string]interface{}); ok {
+		width, _ := mediaSize["x-dimension"].(int)
+		height, _ := mediaSize["y-dimension"].(int)
+		if width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	size, ok := lookupMediaSize(jobAttrs.Media)
+	if !ok {
+		size = defaultIppMediaSize
+	}
+	return int(size.Width), int(size.Height)
+}
+
+// mediaSizeForDimensions The media for a page size in hundredths of a millimetre, in portrait: the nearest
+// well known size within tolerance, otherwise a custom size.
+func mediaSizeForDimensions(width, height float64) ipp.MediaType {
+	size := ipp.MediaType{Width: math.Min(width, height), Height: math.Max(width, height)}
+
+	var nearest ipp.MediaType
+	nearestDistance := math.Inf(1)
+	for _, known := range ippMediaSizeMap {
+		if distance := mediaSizeDistance(size, known); distance < nearestDistance {
+			nearest, nearestDistance = known, distance
+		}
+	}
+	if nearestDistance <= mediaSizeTolerance {
+		return nearest
+	}
+
+	size.Name = customMediaName("", math.Round(size.Width/100)*100, math.Round(size.Height/100)*100)
+	return size
 }
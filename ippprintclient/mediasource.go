@@ -0,0 +1,110 @@
+package ippprintclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/ipp/v2"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// loadedMedia Media loaded in one of the printer's input trays.
+type loadedMedia struct {
+	size      ipp.MediaType
+	source    string
+	mediaType string
+}
+
+// readyMedia The media loaded in the printer, from media-col-ready, or media-ready if the printer
+// only reports the loaded sizes.
+func readyMedia(printerAttrs *ippclient.PrinterAttributes) []loadedMedia {
+	var loaded []loadedMedia
+	for _, col := range printerAttrs.MediaColReady {
+		loaded = append(loaded, loadedMedia{
+			size: ipp.MediaType{
+				Width:  float64(col.MediaSize.XDimension.LowerBound),
+				Height: float64(col.MediaSize.YDimension.LowerBound),
+			},
+			source:    col.MediaSource,
+			mediaType: col.MediaType,
+		})
+	}
+	if len(loaded) > 0 {
+		return loaded
+	}
+
+	for _, name := range printerAttrs.MediaReady {
+		if size, ok := parsePWGMediaName(name); ok {
+			loaded = append(loaded, loadedMedia{size: size})
+		}
+	}
+	return loaded
+}
+
+// selectMediaSource Pick the input tray holding media of the given size and the ticket's media type,
+// preferring the ticket's tray if it names one. If no tray holds the media the job's tray and type are
+// left to the printer, which prompts for the media, or ErrPrintMediaNotReady is returned if failFast.
+func selectMediaSource(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes, size ipp.MediaType, failFast bool) (string, string, error) {
+	source, mediaType := ticketAttrs.MediaSource, ticketAttrs.MediaType
+
+	if source != "" && len(printerAttrs.MediaSourceSupported) > 0 && !containsFold(printerAttrs.MediaSourceSupported, source) {
+		pclog.Supportf("media-source %q not supported by printer, supported=%v", source, printerAttrs.MediaSourceSupported)
+		source = ""
+	}
+
+	loaded := readyMedia(printerAttrs)
+	if len(loaded) == 0 {
+		// The printer doesn't report its trays, nothing to choose from.
+		return source, mediaType, nil
+	}
+
+	var match *loadedMedia
+	for i := range loaded {
+		if mediaSizeDistance(loaded[i].size, size) > mediaSizeTolerance {
+			continue
+		}
+		if mediaType != "" && !strings.EqualFold(loaded[i].mediaType, mediaType) {
+			continue
+		}
+		if source != "" && strings.EqualFold(loaded[i].source, source) {
+			match = &loaded[i]
+			break
+		}
+		if match == nil {
+			match = &loaded[i]
+		}
+	}
+
+	if match == nil {
+		msg := fmt.Sprintf("no input tray holds media %v (%vx%v) of type %q", size.Name, size.Width, size.Height, mediaType)
+		if failFast {
+			pclog.Errorf(msg)
+			return "", "", &OperationError{
+				Type: ErrPrintMediaNotReady,
+				Err:  errors.New(msg),
+			}
+		}
+		pclog.Supportf("%v, the printer will prompt for it", msg)
+		return source, mediaType, nil
+	}
+
+	if source != "" && !strings.EqualFold(match.source, source) {
+		pclog.Supportf("media-source %q doesn't hold media %v, using %q", source, size.Name, match.source)
+	}
+	if mediaType == "" {
+		mediaType = match.mediaType
+	}
+	return match.source, mediaType, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
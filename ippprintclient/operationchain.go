@@ -0,0 +1,153 @@
+package ippprintclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ipp"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// The IPP operations each entry of -ippOperationChain needs the printer to support.
+var chainOperations = map[string][]ipp.Operation{
+	createJobOperation: preferredJobOperations,
+	printJobOperation:  {ipp.OperationPrintJob},
+	sendURIOperation:   {ipp.OperationCreateJob, ipp.OperationSendURI},
+	printURIOperation:  {ipp.OperationPrintURI},
+}
+
+// operationChain The operations of -ippOperationChain the printer supports, in order. Print-Job is also tried
+// when the printer doesn't list its operations, every IPP printer supports it. Send-URI and Print-URI are skipped
+// for printers reached over TLS, the document server is plain HTTP.
+// -ippPrintOperation print-job is the same as -ippOperationChain print-job.
+func operationChain(printerURI string, printerAttributes *ippclient.PrinterAttributes) []string {
+	names := strings.Split(*ippOperationChain, ",")
+	if *ippPrintOperation == "\"print-job\"" || *ippPrintOperation == "print-job" {
+		names = []string{printJobOperation}
+	}
+
+	var chain []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.ToLower(strings.Trim(strings.TrimSpace(name), "\""))
+		required, ok := chainOperations[name]
+		if !ok {
+			pclog.Errorf("unknown operation %q in -ippOperationChain, ignoring it", name)
+			continue
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if (name == sendURIOperation || name == printURIOperation) && printerUsesTLS(printerURI) {
+			pclog.Devf("printer is reached over TLS, skipping %s rather than serving the document over plain HTTP", name)
+			continue
+		}
+		if name == printJobOperation && len(printerAttributes.OperationsSupported) == 0 {
+			chain = append(chain, name)
+			continue
+		}
+		if !operationsSupported(printerAttributes, required) {
+			pclog.Devf("printer doesn't support %s, skipping it", name)
+			continue
+		}
+		chain = append(chain, name)
+	}
+	return chain
+}
+
+// printerUsesTLS Whether the printer is reached over TLS, i.e. an ipps or https printer URI.
+func printerUsesTLS(printerURI string) bool {
+	u, err := url.Parse(printerURI)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, "ipps") || strings.EqualFold(u.Scheme, "https")
+}
+
+// operationDescription The IPP operations an entry of the operation chain sends, e.g. create-job/send-document.
+func operationDescription(operation string) string {
+	switch operation {
+	case createJobOperation:
+		return fmt.Sprintf("%s/%s", createJobOperation, sendDocumentOperation)
+	case sendURIOperation:
+		return fmt.Sprintf("%s/%s", createJobOperation, sendURIOperation)
+	}
+	return operation
+}
+
+// fallsBackToNextOperation Whether the job should be sent again with the next operation of the chain: the printer
+// doesn't support the operation, keeps failing create-job, or, for send-uri and print-uri, can't fetch the document.
+func fallsBackToNextOperation(err error, operation string) bool {
+	var serverErr *documentServerError
+	if errors.As(err, &serverErr) {
+		return true
+	}
+
+	var exhaustedErr *retriesExhaustedError
+	if errors.As(err, &exhaustedErr) {
+		return operation == createJobOperation
+	}
+
+	var statusErr *ippStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.status {
+	case statusErrorOperationNotSupported:
+		return true
+	case statusErrorURISchemeNotSupported, statusErrorDocumentAccessError:
+		return operation == sendURIOperation || operation == printURIOperation
+	}
+	return false
+}
+
+// operationSenders The method sending a job with each operation of the chain.
+var operationSenders = map[string]func(p *ippPrinter, ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (*ippclient.JobAttributes, error){
+	createJobOperation: (*ippPrinter).CreateSendDocument,
+	sendURIOperation:   (*ippPrinter).CreateSendURI,
+	printURIOperation:  (*ippPrinter).PrintURI,
+	printJobOperation:  (*ippPrinter).PrintJob,
+}
+
+// sendJob Send the job with the first operation of the chain, falling back to the next one whenever the printer
+// doesn't support it. Returns the operation that sent the job.
+func (p *ippPrinter) sendJob(ctx context.Context, chain []string, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (string, error) {
+	var err error
+	for i, operation := range chain {
+		if i > 0 {
+			docReader, err = docReader.Reset()
+			if err != nil {
+				return "", &OperationError{
+					Type: ErrPrintDefaultError,
+					Err:  fmt.Errorf("failed to read document: %v", err),
+				}
+			}
+
+			msg := fmt.Sprintf("%s failed, falling back to %s", operationDescription(chain[i-1]), operationDescription(operation))
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+		}
+
+		pclog.Devf("Printing job using %s operation, document-format=%v", operationDescription(operation), docFormat)
+		send, ok := operationSenders[operation]
+		if !ok {
+			send = operationSenders[printJobOperation]
+		}
+		_, err = send(p, ctx, jobTemplate, printerURI, docReader, docFormat)
+		if err == nil {
+			p.operation, p.docFormat = operation, docFormat
+			return operation, nil
+		}
+		if !fallsBackToNextOperation(err, operation) {
+			return operation, err
+		}
+		pclog.Errorf("%s failed: %v", operationDescription(operation), err)
+	}
+	return "", err
+}
@@ -1,6 +1,7 @@
 package ippprintclient
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"flag"
@@ -19,6 +20,7 @@ import (
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3/finishings"
 	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/raster"
 	"bitbucket.org/papercutsoftware/pmitc-coordinator/util/config"
 )
 
@@ -29,6 +31,8 @@ const (
 	createJobOperation       = "create-job"
 	sendDocumentOperation    = "send-document"
 	printJobOperation        = "print-job"
+	sendURIOperation         = "send-uri"
+	printURIOperation        = "print-uri"
 	cancelJobOperation       = "cancel-job"
 	validateJobOperation     = "validate-job"
 	getPrinterAttrsOperation = "get-printer-attributes"
@@ -58,6 +62,17 @@ func printJob(ticketPath, printerURI string,
 		return opErr
 	}
 
+	// Check the document is what the ticket says it is. Peeking leaves the data in the buffer to be spooled.
+	document := bufio.NewReaderSize(file, sniffLength)
+	head, err := document.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		opErr.Err = fmt.Errorf("failed to read document: %v", err)
+		return opErr
+	}
+	if err := reconcileDocumentFormat(ticketAttrs, head, *documentFormatMismatch == documentFormatMismatchFail); err != nil {
+		return err
+	}
+
 	var ippCreds *ippclient.IPPCredentials = nil
 	if ticketAttrs.Credentials.Username != "" && ticketAttrs.Credentials.Password != "" {
 		ippCreds = &ippclient.IPPCredentials{
@@ -76,6 +91,8 @@ func printJob(ticketPath, printerURI string,
 			pclog.Devf("failed to close ipp client: %v", err)
 		}
 	}()
+	// Background refreshes of the attribute cache use the client, let them finish before it is closed.
+	defer attribCache.Wait()
 
 	pclog.Devf("requesting PrintJob with printerURI: %v, ticketAttrs: %+v", printerURI, ticketAttrs)
 	// Context with deadline for the whole printing operation.
@@ -88,48 +105,68 @@ func printJob(ticketPath, printerURI string,
 	defer cancel()
 
 	var printerAttributes *ippclient.PrinterAttributes = nil
+	fetchPrinterAttributes := func(ctx context.Context, stateOnly bool) (*ippclient.PrinterAttributes, error) {
+		if stateOnly {
+			return waitForPrinterReady(ctx, printerURI, ippClient, ippCreds, printerStateAttributes)
+		}
+		return waitForPrinterReady(ctx, printerURI, ippClient, ippCreds, printerReadyAttributes)
+	}
 
 	// Try to get the ipp-printer-attributes from cache.
 	// This is a best effort only, if the printer data is not cached it's not an error.
-
+	// On a cache miss only one process reaches the printer, others printing to the same
+	// printer at the same time wait for its result.
+	fromCache := false
 	if attribCache != nil {
-		printerAttributes, err = attribCache.GetPrinterAttributes(printerURI)
-		if err == nil {
-			processingLogger.LogOperationAttempt(printJobOperation, 1, "ipp-printer-attribute-cache: Found", "0")
-			pclog.Devf("ipp-printer-attribute-cache: Found printer attributes for: %v", printerURI)
-		}
+		printerAttributes, fromCache, err = attribCache.RefreshPrinterAttributes(ctx, printerURI, fetchPrinterAttributes)
+	} else {
+		printerAttributes, err = fetchPrinterAttributes(ctx, false)
+	}
+
+	if fromCache {
+		processingLogger.LogOperationAttempt(printJobOperation, 1, "ipp-printer-attribute-cache: Found", "0")
+		pclog.Devf("ipp-printer-attribute-cache: Found printer attributes for: %v", printerURI)
 	} else {
 		processingLogger.LogOperationAttempt(printJobOperation, 1, "ipp-printer-attribute-cache: Not Found", "0")
-		pclog.Supportf("ipp-printer-attribute-cache: Failed to get cached attributes: %v - %v,"+
-			" reaching the printer", printerURI, err)
+		pclog.Supportf("ipp-printer-attribute-cache: No cached attributes for: %v, reached the printer", printerURI)
+	}
+
+	if err != nil {
+		pclog.Errorf("waitForPrinterReady Failed: %v - %v", printerURI, err)
+		return err
+	}
+
+	var spoolSource io.Reader = document
+	spoolSize := documentSize(file)
+	if injectsPJLHeader(ticketAttrs) {
+		spoolSource = injectPJLHeader(ticketAttrs, document)
+		spoolSize = -1
+		processingLogger.LogOperationAttempt(printJobOperation, 1, "pdl override: PJL header injected", "")
 	}
 
-	if err != nil || printerAttributes == nil {
-		// If failure to get from cache, or the printer info doesn't exist in cache, reach the printer.
-		printerAttributes, err = waitForPrinterReady(ctx, printerURI, ippClient, ippCreds)
+	// The spool file is removed once the job is sent, by the goroutine sending it.
+	docReader, cleanupSpool, err := spoolDocument(config.TmpDir, spoolSource, spoolSize)
+	if err != nil {
+		return err
+	}
+
+	// PDFs can fill in the orientation and media the ticket leaves to the document. Inspecting reads the document,
+	// so it needs to be spooled.
+	if sameDocumentFormat(ticketAttrs.DocumentFormat, documentFormatPDF) && *spoolStrategy != spoolStrategyStream {
+		docReader, err = inspectSpooledPDF(ticketAttrs, docReader)
 		if err != nil {
-			pclog.Errorf("waitForPrinterReady Failed: %v - %v", printerURI, err)
+			cleanupSpool()
 			return err
-		} else {
-			if attribCache != nil {
-				// Try to set it in cache. If it fails, don't fail the print job.
-				_ = attribCache.SetPrinterAttributes(printerURI, printerAttributes)
-			}
 		}
 	}
 
-	jobTemplateAttrs := makeIPPJobAttributes(ticketAttrs, printerAttributes)
-	pclog.Supportf("got ipp attrs for job: %v", jobTemplateAttrs)
+	learned := learnedBehaviour(attribCache, printerURI, printerAttributes)
+	ticketAttrs = preferLearnedDocumentFormat(ticketAttrs, printerAttributes, learned)
 
-	selectedDocFormat := mapDocumentFormat(ticketAttrs, printerAttributes)
-	if selectedDocFormat == "" {
-		pclog.Errorf("document format not supported :printing=%s|supported=%v failed",
-			ticketAttrs.DocumentFormat, printerAttributes.DocumentFormatSupported)
-		return &OperationError{
-			Type: ErrPrintDocFormatMismatch,
-			Err: fmt.Errorf("document format not supported :printing=%s|supported=%v failed",
-				ticketAttrs.DocumentFormat, printerAttributes.DocumentFormatSupported),
-		}
+	job, err := buildJob(ticketAttrs, printerAttributes)
+	if err != nil {
+		cleanupSpool()
+		return err
 	}
 
 	monitor := &monitor{
@@ -141,21 +178,39 @@ func printJob(ticketPath, printerURI string,
 
 	printer := &ippPrinter{
 		ippClient:   ippClient,
+		httpClient:  httpClient,
 		Credentials: ippCreds,
 		TmpDir:      config.TmpDir,
 		monitor:     monitor,
+		learned:     learned,
 	}
+	printer.Credentials = learnedCredentials(ippCreds, learned)
 
 	errChan := make(chan error)
 	monitorCompleteChan := make(chan struct{})
 
 	go func(ctx context.Context) {
-		if !(*ippPrintOperation == "\"print-job\"" || *ippPrintOperation == "print-job") && operationsSupported(printerAttributes, preferredJobOperations) {
-			pclog.Devf("Printing job using CreateSendDocument operation, document-format=%v", selectedDocFormat)
-			_, err = printer.CreateSendDocument(ctx, jobTemplateAttrs, printerURI, file, selectedDocFormat)
-		} else {
-			pclog.Devf("Printing job using Print-Job operation, document-format=%v", selectedDocFormat)
-			_, err = printer.PrintJob(ctx, jobTemplateAttrs, printerURI, file, selectedDocFormat)
+		defer cleanupSpool()
+
+		err := submitJob(ctx, printer, printerURI, job, docReader, printerAttributes)
+		if err != nil && fromCache && invalidatesPrinterAttributes(err) {
+			err = retryWithFreshPrinterAttributes(ctx, printer, printerURI, ticketAttrs, docReader, attribCache, fetchPrinterAttributes, err)
+		}
+
+		if err == nil {
+			rememberBehaviour(attribCache, printerURI, printer, printerAttributes)
+		} else if learned != nil && rejectedByPrinter(err) {
+			// The next job goes the configured way, and learns again.
+			forgetBehaviour(attribCache, printerURI)
+		}
+
+		if spoolErr := spoolFailure(docReader); err != nil && spoolErr != nil {
+			pclog.Errorf("failed to spool job: %v", spoolErr)
+			errChan <- &OperationError{
+				Type: ErrPrintSpool,
+				Err:  spoolErr,
+			}
+			return
 		}
 
 		if err != nil {
@@ -206,7 +261,196 @@ func printJob(ticketPath, printerURI string,
 	}
 }
 
-// waitForPrinterReady Wait for printer to be ready. Poll the printer for IPP attributes,
+// preparedJob A job ready to send to the printer.
+type preparedJob struct {
+	template  *ippclient.PrintJobTemplateAttributes
+	docFormat string
+	// Number of times the document is sent because the printer can't make the copies itself, 1 if it can.
+	emulatedCopies int
+	// Copies the PJL header makes, 0 if the copies are asked for in IPP.
+	pjlCopies int
+	// How to rasterise an image the printer can't take as is, nil to send the document unchanged.
+	rasterise *raster.Options
+	// How the document is compressed, see selectCompression.
+	compression string
+}
+
+// buildJob Build the job template and select the document format for the printer.
+// Returns an OperationError if the printer supports none of the ticket's document formats.
+func buildJob(ticketAttrs *jobticket.JobTicket, printerAttributes *ippclient.PrinterAttributes) (*preparedJob, error) {
+	selectedDocFormat := mapDocumentFormat(ticketAttrs, printerAttributes)
+	rasterFormat := ""
+	if selectedDocFormat == "" {
+		// Images the printer doesn't take can still be sent as the raster every IPP Everywhere and AirPrint printer takes.
+		rasterFormat = selectRasterFormat(ticketAttrs, printerAttributes)
+		selectedDocFormat = rasterFormat
+	}
+	if selectedDocFormat == "" {
+		pclog.Errorf("document format not supported :printing=%s|supported=%v failed",
+			ticketAttrs.DocumentFormat, printerAttributes.DocumentFormatSupported)
+		return nil, &OperationError{
+			Type: ErrPrintDocFormatMismatch,
+			Err: fmt.Errorf("document format not supported :printing=%s|supported=%v failed",
+				ticketAttrs.DocumentFormat, printerAttributes.DocumentFormatSupported),
+		}
+	}
+
+	job := &preparedJob{docFormat: selectedDocFormat, emulatedCopies: 1}
+	if injectsPJLHeader(ticketAttrs) && ticketAttrs.Copies > 1 {
+		// The PJL header makes the copies, asking for them in IPP as well would multiply them.
+		job.pjlCopies = ticketAttrs.Copies
+		singleCopy := *ticketAttrs
+		singleCopy.Copies = 1
+		ticketAttrs = &singleCopy
+	} else if copiesNeedEmulation(ticketAttrs, printerAttributes, selectedDocFormat) {
+		job.emulatedCopies = ticketAttrs.Copies
+		singleCopy := *ticketAttrs
+		singleCopy.Copies = 1
+		ticketAttrs = &singleCopy
+	}
+
+	jobTemplateAttrs, err := makeIPPJobAttributes(ticketAttrs, printerAttributes)
+	if err != nil {
+		return nil, err
+	}
+	pclog.Supportf("got ipp attrs for job: %v", jobTemplateAttrs)
+	job.template = jobTemplateAttrs
+
+	job.compression = selectCompression(printerAttributes, selectedDocFormat, *compression)
+
+	if rasterFormat != "" {
+		job.rasterise = rasterOptions(rasterFormat, jobTemplateAttrs, printerAttributes)
+		msg := fmt.Sprintf("printer doesn't support %s, rasterising to %s at %dx%ddpi %s",
+			ticketAttrs.DocumentFormat, rasterFormat, job.rasterise.XRes, job.rasterise.YRes, job.rasterise.ColorSpace)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+	}
+
+	return job, nil
+}
+
+// submitJob Send the job to the printer with the operations of -ippOperationChain it supports, falling back
+// down the chain when one turns out not to work, see sendJob. Emulated copies are sent as separate jobs,
+// only the last of them is monitored.
+func submitJob(ctx context.Context, printer *ippPrinter, printerURI string,
+	job *preparedJob,
+	docReader readCloseResetter,
+	printerAttributes *ippclient.PrinterAttributes) error {
+
+	if job.rasterise != nil {
+		rasterReader, cleanupRaster, err := rasteriseDocument(printer.TmpDir, docReader, job.rasterise)
+		if err != nil {
+			return err
+		}
+		defer cleanupRaster()
+		docReader = rasterReader
+	}
+
+	if job.emulatedCopies > 1 {
+		msg := fmt.Sprintf("printer can't make copies, emulating %d copies by sending the document %d times", job.emulatedCopies, job.emulatedCopies)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+	}
+	printer.compression = job.compression
+	defer func() { printer.skipMonitor = false }()
+
+	chain := operationChain(printerURI, printerAttributes)
+	if len(chain) == 0 {
+		pclog.Supportf("printer supports none of the operations in -ippOperationChain %q, trying %s", *ippOperationChain, printJobOperation)
+		chain = []string{printJobOperation}
+	}
+	chain = preferLearnedOperation(chain, printer.learned)
+
+	// Learned credentials are already settled.
+	if chain[0] == printJobOperation && *ippAuthProbe && !usesLearnedCredentials(printer) {
+		if err := printer.probeCredentials(ctx, printerURI, job.template, printerAttributes); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for copyNumber := 1; copyNumber <= job.emulatedCopies; copyNumber++ {
+		if copyNumber > 1 {
+			docReader, err = docReader.Reset()
+			if err != nil {
+				return &OperationError{
+					Type: ErrPrintDefaultError,
+					Err:  fmt.Errorf("failed to read document: %v", err),
+				}
+			}
+		}
+		printer.skipMonitor = copyNumber < job.emulatedCopies
+
+		operation, err := printer.sendJob(ctx, chain, job.template, printerURI, docReader, job.docFormat)
+		if err != nil {
+			return err
+		}
+		// The remaining copies go straight to the operation that worked.
+		for chain[0] != operation {
+			chain = chain[1:]
+		}
+	}
+	return nil
+}
+
+// copiesNeedEmulation Whether the printer can't make the ticket's copies itself, either because copies-supported
+// is 1..1 or because the printer is known to ignore copies for the document format.
+func copiesNeedEmulation(ticketAttrs *jobticket.JobTicket, printerAttributes *ippclient.PrinterAttributes, docFormat string) bool {
+	if ticketAttrs.Copies <= 1 {
+		return false
+	}
+	if printerAttributes.CopiesSupported.UpperBound == 1 {
+		return true
+	}
+	for _, format := range ticketAttrs.EmulateCopiesFormats {
+		if format == "*" || strings.EqualFold(strings.TrimSpace(format), docFormat) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryWithFreshPrinterAttributes The printer rejected a job built from cached attributes, which are
+// likely stale. Fetch fresh attributes from the printer, replacing the cache entry, and submit the job
+// once more with a rebuilt job template. Returns jobErr if fresh attributes can't be fetched.
+// The cache isn't consulted, its entry may be locked by another process and so can't be invalidated.
+func retryWithFreshPrinterAttributes(ctx context.Context, printer *ippPrinter, printerURI string,
+	ticketAttrs *jobticket.JobTicket,
+	docReader readCloseResetter,
+	attribCache *printerattributecache.PrinterAttributeCache,
+	fetch printerattributecache.FetchFunc,
+	jobErr error) error {
+
+	msg := fmt.Sprintf("ipp-printer-attribute-cache: job rejected, invalidating cached attributes and retrying: %v", jobErr)
+	pclog.Supportf(msg)
+	processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+
+	printerAttributes, err := fetch(ctx, false)
+	if err != nil {
+		pclog.Errorf("failed to refresh printer attributes after job rejected: %v", err)
+		return jobErr
+	}
+	if err := attribCache.SetPrinterAttributes(printerURI, printerAttributes); err != nil {
+		pclog.Devf("ipp-printer-attribute-cache: failed to save attributes for %v: %v", printerURI, err)
+	}
+
+	job, err := buildJob(ticketAttrs, printerAttributes)
+	if err != nil {
+		return err
+	}
+
+	docReader, err = docReader.Reset()
+	if err != nil {
+		return &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to read document: %v", err),
+		}
+	}
+
+	return submitJob(ctx, printer, printerURI, job, docReader, printerAttributes)
+}
+
+// waitForPrinterReady Wait for printer to be ready. Poll the printer for the requested IPP attributes,
 // and wait till it's ready with timeout. Default printer ready timeout is 600sec.
 // Returns an OperationError at failure.
 func waitForPrinterReady(
@@ -214,6 +458,7 @@ func waitForPrinterReady(
 	printerURI string,
 	ippClient *ippclient.IPPClient,
 	ippCreds *ippclient.IPPCredentials,
+	requestedAttributes []string,
 ) (*ippclient.PrinterAttributes, error) {
 
 	printerReadyTimeout := time.NewTimer(time.Duration(*printerReadyTimeoutSec) * time.Second)
@@ -248,7 +493,7 @@ getPrinterAttrs:
 			attempts++
 			//TODO: future: do get printer attribute in a separate thread
 			getPrinterAttrsOpStartTime := time.Now()
-			printerAttrsResponse, err := ippClient.GetPrinterAttributes(printerURI, printerReadyAttributes, ippCreds)
+			printerAttrsResponse, err := ippClient.GetPrinterAttributes(printerURI, requestedAttributes, ippCreds)
 			duration := time.Since(getPrinterAttrsOpStartTime).String()
 			if err != nil && err != ippclient.ErrMalformedAttributes {
 				if reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err); isHttpStatusError {
@@ -333,18 +578,24 @@ func isSpoolAreaFull(printerStateReasons []string) bool {
 	return false
 }
 
-func makeIPPJobAttributes(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) *ippclient.PrintJobTemplateAttributes {
+func makeIPPJobAttributes(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) (*ippclient.PrintJobTemplateAttributes, error) {
 	mediaColSupported := printerAttrs.MediaColSupported != nil || len(printerAttrs.MediaColSupported) != 0
 
 	jobAttrs := &ippclient.PrintJobTemplateAttributes{
 		AttributeCopies: ticketAttrs.Copies,
 		PrintColorMode:  ticketAttrs.PrintColorMode,
 		AttributesSides: ticketAttrs.Sides,
-		Finishings:      mapFinishings(ticketAttrs, printerAttrs),
 		MultiDocHandle:  ippclient.SeparateDocumentsCollatedCopies,
 	}
 
-	mediaSize := getIppMediaSizeFromName(ticketAttrs.PaperName)
+	// Newer printers may ignore or reject the finishings enums when they support finishings-col.
+	if finishingsColSupported(printerAttrs) {
+		jobAttrs.FinishingsCol = mapFinishingsCol(ticketAttrs, printerAttrs)
+	} else {
+		jobAttrs.Finishings = mapFinishings(ticketAttrs, printerAttrs)
+	}
+
+	mediaSize := selectMedia(ticketAttrs, printerAttrs)
 	if mediaColSupported {
 		jobAttrs.MediaCol = map[string]interface{}{
 			"media-size": map[string]interface{}{
@@ -352,13 +603,33 @@ func makeIPPJobAttributes(ticketAttrs *jobticket.JobTicket, printerAttrs *ippcli
 				"y-dimension": int(mediaSize.Height),
 			},
 		}
+
+		source, mediaType, err := selectMediaSource(ticketAttrs, printerAttrs, mediaSize, *mediaNotReady == mediaNotReadyFail)
+		if err != nil {
+			return nil, err
+		}
+		if source != "" {
+			jobAttrs.MediaCol["media-source"] = source
+		}
+		if mediaType != "" {
+			jobAttrs.MediaCol["media-type"] = mediaType
+		}
 	} else {
 		jobAttrs.Media = mediaSize.Name
+		if ticketAttrs.MediaSource != "" || ticketAttrs.MediaType != "" {
+			pclog.Supportf("printer doesn't support media-col, ignoring media-source %q and media-type %q",
+				ticketAttrs.MediaSource, ticketAttrs.MediaType)
+		}
+	}
+
+	if err := reconcileCapabilities(jobAttrs, printerAttrs, *capabilityMode); err != nil {
+		return nil, err
 	}
 
+	applyOptionalJobAttributes(jobAttrs, ticketAttrs, printerAttrs)
 	applyPdlOverrides(jobAttrs, ticketAttrs)
 
-	return jobAttrs
+	return jobAttrs, nil
 }
 
 // NOTE: map the document formats detected by analysis to a version supported by the printer
@@ -404,9 +675,7 @@ func mapFinishings(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.Pri
 			continue
 		}
 		// Position of some finishing options change with orientation of document
-		if ticketAttrs.OptionalPDLOverrides.Orientation == jobticket.OrientationLandscape {
-			reqFinishingsEnum = evaluateFinishingsForLandscape(reqFinishingsEnum)
-		}
+		reqFinishingsEnum = rotateFinishings(reqFinishingsEnum, ticketAttrs.OptionalPDLOverrides.Orientation)
 		if finishingsEnum, ok := getSupportedFinishingsEnum(reqFinishingsEnum, printerAttrs.FinishingsSupported); ok {
 			allFinishings = append(allFinishings, finishingsEnum)
 		}
@@ -438,20 +707,37 @@ func getSupportedFinishingsEnum(reqFinishingsEnum finishings.Finishings, finishi
 	return 0, false
 }
 
-func evaluateFinishingsForLandscape(enum finishings.Finishings) finishings.Finishings {
+// orientationRotation How far, in sheetPosition steps, finishing positions move clockwise for each orientation.
+// Landscape content is rotated 90 degrees anti clockwise, so the top left of the content is the bottom
+// left of the sheet.
+var orientationRotation = map[jobticket.OrientationType]sheetPosition{
+	jobticket.OrientationLandscape:        sheetPositions - 2,
+	jobticket.OrientationReverseLandscape: 2,
+	jobticket.OrientationReversePortrait:  4,
+}
+
+// rotateFinishings Map a positional finishing to the sheet position matching the orientation of the document.
+// Finishings without a position, and portrait documents, are left as they are.
+func rotateFinishings(enum finishings.Finishings, orientation jobticket.OrientationType) finishings.Finishings {
+	rotation, ok := orientationRotation[orientation]
+	if !ok {
+		return enum
+	}
+
 	result := enum
-	switch enum {
-	case finishings.FinishingsStapleTopLeft:
-		result = finishings.FinishingsStapleBottomLeft
-	case finishings.FinishingsStapleBottomLeft:
-		result = finishings.FinishingsStapleBottomRight
-	case finishings.FinishingsStapleTopRight:
-		result = finishings.FinishingsStapleTopLeft
-	case finishings.FinishingsStapleBottomRight:
-		result = finishings.FinishingsStapleTopRight
+	for _, family := range positionalFinishings {
+		for position, finishing := range family {
+			if finishing != enum {
+				continue
+			}
+			if rotated, ok := family[(position+rotation)%sheetPositions]; ok {
+				result = rotated
+			}
+		}
 	}
+
 	if result != enum {
-		pclog.Supportf("Finishings changed for landscape orientation input %d, mapped to %d", enum, result)
+		pclog.Supportf("Finishings changed for %s orientation input %d, mapped to %d", orientation, enum, result)
 	}
 	return result
 }
@@ -565,7 +851,7 @@ func checkPrinter(printerURI string, httpClient ippclient.HttpClientInterface,
 		}
 	}
 	// Update the attribute cache only if the printer is ready.
-	// This info will be valid for a while (30sec). If ipp-print-client uses the same printer URI
+	// This info will be valid for a while (see -printerAttributeCacheStateTTLSec). If ipp-print-client uses the same printer URI
 	// during that time, the cached value will be used preventing reaching the printer.
 	if attribCache != nil {
 		if ready, _ := isPrinterReady(printerAttrsResponse.PrinterAttributes); ready {
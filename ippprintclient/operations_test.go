@@ -1,12 +1,26 @@
 package ippprintclient
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"bitbucket.org/papercutsoftware/gopapercut/print/ipp"
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3/finishings"
 	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
 )
 
 func TestMapFinishings_Ok(t *testing.T) {
@@ -228,3 +242,1302 @@ func TestCheckPrinterDeviceIdMatch_NoMatch(t *testing.T) {
 		t.Fatalf("expected passed deviceIdRaw and ippclient.PrinterAttributes.PrinterDeviceID to not match")
 	}
 }
+
+func TestInvalidatesPrinterAttributes_Sanity(t *testing.T) {
+	tests := []struct {
+		err    error
+		result bool
+	}{
+		{&ippStatusError{operation: createJobOperation, status: statusErrorAttributesOrValuesNotSupported}, true},
+		{&ippStatusError{operation: printJobOperation, status: statusErrorDocumentFormatNotSupported}, true},
+		{&ippStatusError{operation: sendDocumentOperation, status: statusErrorOperationNotSupported}, true},
+		{&ippStatusError{operation: sendURIOperation, status: statusErrorOperationNotSupported}, true},
+		{&ippStatusError{operation: printURIOperation, status: statusErrorOperationNotSupported}, true},
+		{&ippStatusError{operation: printJobOperation, status: statusErrorOperationNotSupported}, false},
+		{&ippStatusError{operation: printJobOperation, status: 0x0400}, false},
+		{&OperationError{Type: ErrPrintIPPPrintJob, Err: fmt.Errorf("print-job failed: %w",
+			&ippStatusError{operation: printJobOperation, status: statusErrorAttributesOrValuesNotSupported})}, true},
+		{&OperationError{Type: ErrPrintIPPPrintJob, Err: fmt.Errorf("print-job failed")}, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if invalidatesPrinterAttributes(test.err) != test.result {
+			t.Fatalf("invalidatesPrinterAttributes(%v) expected %v", test.err, test.result)
+		}
+	}
+}
+
+func TestIppStatus_Recoverable(t *testing.T) {
+	tests := []struct {
+		status ippclient.Status
+		result bool
+	}{
+		{ippclient.StatusErrorBadRequest, false},
+		{statusErrorDocumentFormatNotSupported, false},
+		{ippclient.StatusErrorInternal, true},
+		// Operation not supported is left to invalidatesPrinterAttributes.
+		{statusErrorOperationNotSupported, true},
+	}
+
+	for _, test := range tests {
+		if ippStatus(test.status).Recoverable() != test.result {
+			t.Fatalf("ippStatus(%#x).Recoverable() expected %v", int(test.status), test.result)
+		}
+	}
+}
+
+func TestLookupMediaSize_Sanity(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  float64
+		height float64
+		ok     bool
+	}{
+		{"A4", 21000, 29700, true},
+		{"a4", 21000, 29700, true},
+		{" letter ", 21590, 27940, true},
+		{"iso_a5_148x210mm", 14800, 21000, true},
+		{"na_letter_8.5x11in", 21590, 27940, true},
+		{"custom_receipt_80x200mm", 8000, 20000, true},
+		{"Tabloid Extra", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		size, ok := lookupMediaSize(test.name)
+		if ok != test.ok || size.Width != test.width || size.Height != test.height {
+			t.Fatalf("lookupMediaSize(%q) = %v, %v", test.name, size, ok)
+		}
+	}
+}
+
+func TestSelectMedia_ExactMatch(t *testing.T) {
+	ticket := &jobticket.JobTicket{PaperName: "a4", PaperWidthMM: 210, PaperHeightMM: 297}
+	printerAttrs := &ippclient.PrinterAttributes{
+		MediaSupported: []string{"na_letter_8.5x11in", "iso_a4_210x297mm"},
+	}
+
+	if media := selectMedia(ticket, printerAttrs); media.Name != "iso_a4_210x297mm" {
+		t.Fatalf("expected iso_a4_210x297mm, got %v", media)
+	}
+}
+
+func TestSelectMedia_NearestMatch(t *testing.T) {
+	ticket := &jobticket.JobTicket{PaperName: "Letter", PaperWidthMM: 216, PaperHeightMM: 279}
+	printerAttrs := &ippclient.PrinterAttributes{
+		MediaSupported: []string{"iso_a3_297x420mm", "iso_a4_210x297mm", "iso_a5_148x210mm"},
+	}
+
+	if media := selectMedia(ticket, printerAttrs); media.Name != "iso_a4_210x297mm" {
+		t.Fatalf("expected nearest iso_a4_210x297mm, got %v", media)
+	}
+}
+
+func TestSelectMedia_TicketDimensions(t *testing.T) {
+	ticket := &jobticket.JobTicket{PaperName: "Receipt", PaperWidthMM: 80, PaperHeightMM: 200}
+	printerAttrs := &ippclient.PrinterAttributes{
+		MediaSupported: []string{"iso_a4_210x297mm"},
+		MediaSizeSupported: []ippclient.MediaSize{
+			{XDimension: ipp.RangeOfInteger{LowerBound: 21000, UpperBound: 21000}, YDimension: ipp.RangeOfInteger{LowerBound: 29700, UpperBound: 29700}},
+			{XDimension: ipp.RangeOfInteger{LowerBound: 5000, UpperBound: 21600}, YDimension: ipp.RangeOfInteger{LowerBound: 5000, UpperBound: 100000}},
+		},
+	}
+
+	media := selectMedia(ticket, printerAttrs)
+	if media.Name != "custom_receipt_80x200mm" || media.Width != 8000 || media.Height != 20000 {
+		t.Fatalf("expected custom_receipt_80x200mm, got %v", media)
+	}
+
+	printerAttrs.MediaSizeSupported = printerAttrs.MediaSizeSupported[:1]
+	if media := selectMedia(ticket, printerAttrs); media.Name != "iso_a4_210x297mm" {
+		t.Fatalf("expected downgrade to iso_a4_210x297mm, got %v", media)
+	}
+}
+
+func TestSelectMediaSource_Sanity(t *testing.T) {
+	a4 := ippclient.MediaSize{
+		XDimension: ipp.RangeOfInteger{LowerBound: 21000, UpperBound: 21000},
+		YDimension: ipp.RangeOfInteger{LowerBound: 29700, UpperBound: 29700},
+	}
+	letter := ippclient.MediaSize{
+		XDimension: ipp.RangeOfInteger{LowerBound: 21590, UpperBound: 21590},
+		YDimension: ipp.RangeOfInteger{LowerBound: 27940, UpperBound: 27940},
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		MediaSourceSupported: []string{"tray-1", "tray-2", "tray-3"},
+		MediaColReady: []ippclient.MediaCollection{
+			{MediaSize: letter, MediaSource: "tray-1", MediaType: "stationery"},
+			{MediaSize: a4, MediaSource: "tray-2", MediaType: "stationery"},
+			{MediaSize: a4, MediaSource: "tray-3", MediaType: "labels"},
+		},
+	}
+	a4Size, _ := lookupMediaSize("A4")
+
+	tests := []struct {
+		ticket    jobticket.JobTicket
+		source    string
+		mediaType string
+	}{
+		{jobticket.JobTicket{}, "tray-2", "stationery"},
+		{jobticket.JobTicket{MediaType: "labels"}, "tray-3", "labels"},
+		{jobticket.JobTicket{MediaSource: "tray-3"}, "tray-3", "labels"},
+		{jobticket.JobTicket{MediaSource: "tray-1"}, "tray-2", "stationery"},
+	}
+	for _, test := range tests {
+		source, mediaType, err := selectMediaSource(&test.ticket, printerAttrs, a4Size, true)
+		if err != nil || source != test.source || mediaType != test.mediaType {
+			t.Fatalf("selectMediaSource(%+v) = %v, %v, %v", test.ticket, source, mediaType, err)
+		}
+	}
+
+	ticket := &jobticket.JobTicket{MediaType: "transparency"}
+	if _, _, err := selectMediaSource(ticket, printerAttrs, a4Size, true); err == nil {
+		t.Fatalf("expected media not ready error")
+	}
+	source, mediaType, err := selectMediaSource(ticket, printerAttrs, a4Size, false)
+	if err != nil || source != "" || mediaType != "transparency" {
+		t.Fatalf("expected the printer to prompt for the media, got %v, %v, %v", source, mediaType, err)
+	}
+}
+
+func TestReconcileCapabilities_BestEffort(t *testing.T) {
+	printerAttrs := &ippclient.PrinterAttributes{
+		SidesSupported:          []string{"one-sided"},
+		PrintColorModeSupported: []string{"auto", "monochrome"},
+		CopiesSupported:         ipp.RangeOfInteger{LowerBound: 1, UpperBound: 99},
+	}
+	jobAttrs := &ippclient.PrintJobTemplateAttributes{
+		AttributeCopies: 150,
+		PrintColorMode:  "color",
+		AttributesSides: "two-sided-long-edge",
+	}
+
+	if err := reconcileCapabilities(jobAttrs, printerAttrs, capabilityModeBestEffort); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jobAttrs.AttributesSides != "one-sided" || jobAttrs.PrintColorMode != "monochrome" || jobAttrs.AttributeCopies != 99 {
+		t.Fatalf("expected downgraded attributes, got %+v", jobAttrs)
+	}
+}
+
+func TestReconcileCapabilities_Strict(t *testing.T) {
+	printerAttrs := &ippclient.PrinterAttributes{
+		SidesSupported:          []string{"one-sided", "two-sided-long-edge"},
+		PrintColorModeSupported: []string{"monochrome"},
+	}
+	jobAttrs := &ippclient.PrintJobTemplateAttributes{
+		AttributeCopies: 2,
+		PrintColorMode:  "color",
+		AttributesSides: "two-sided-long-edge",
+	}
+
+	err := reconcileCapabilities(jobAttrs, printerAttrs, capabilityModeStrict)
+	var opErr *OperationError
+	if !errors.As(err, &opErr) || opErr.Type != ErrPrintUnsupportedAttributes {
+		t.Fatalf("expected ErrPrintUnsupportedAttributes, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "print-color-mode=color") || strings.Contains(err.Error(), "sides") {
+		t.Fatalf("expected only the color mode to be unsupported, got %v", err)
+	}
+	if jobAttrs.PrintColorMode != "color" {
+		t.Fatalf("strict mode must not change the job")
+	}
+}
+
+func TestBuildJob_CopiesEmulation(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		Copies:         3,
+		PrintColorMode: "monochrome",
+		Sides:          "one-sided",
+		DocumentFormat: "image/urf",
+		PaperName:      "A4",
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		DocumentFormatSupported: []string{"application/pdf", "image/urf"},
+		CopiesSupported:         ipp.RangeOfInteger{LowerBound: 1, UpperBound: 999},
+	}
+
+	job, err := buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.emulatedCopies != 1 || job.template.AttributeCopies != 3 {
+		t.Fatalf("expected the printer to make the copies, got %d emulated, %d copies", job.emulatedCopies, job.template.AttributeCopies)
+	}
+
+	ticket.EmulateCopiesFormats = []string{"image/urf"}
+	job, err = buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.emulatedCopies != 3 || job.template.AttributeCopies != 1 || ticket.Copies != 3 {
+		t.Fatalf("expected 3 emulated copies, got %d emulated, %d copies", job.emulatedCopies, job.template.AttributeCopies)
+	}
+
+	ticket.EmulateCopiesFormats = nil
+	printerAttrs.CopiesSupported = ipp.RangeOfInteger{LowerBound: 1, UpperBound: 1}
+	job, err = buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.emulatedCopies != 3 || job.template.AttributeCopies != 1 {
+		t.Fatalf("expected 3 emulated copies, got %d emulated, %d copies", job.emulatedCopies, job.template.AttributeCopies)
+	}
+}
+
+func TestRotateFinishings_Families(t *testing.T) {
+	tests := map[string][]struct {
+		portrait         finishings.Finishings
+		landscape        finishings.Finishings
+		reverseLandscape finishings.Finishings
+		reversePortrait  finishings.Finishings
+	}{
+		"staple": {
+			{finishings.FinishingsStapleTopLeft, finishings.FinishingsStapleBottomLeft, finishings.FinishingsStapleTopRight, finishings.FinishingsStapleBottomRight},
+			{finishings.FinishingsStapleTopRight, finishings.FinishingsStapleTopLeft, finishings.FinishingsStapleBottomRight, finishings.FinishingsStapleBottomLeft},
+			{finishings.FinishingsStapleBottomRight, finishings.FinishingsStapleTopRight, finishings.FinishingsStapleBottomLeft, finishings.FinishingsStapleTopLeft},
+			{finishings.FinishingsStapleBottomLeft, finishings.FinishingsStapleBottomRight, finishings.FinishingsStapleTopLeft, finishings.FinishingsStapleTopRight},
+		},
+		"staple-dual": {
+			{finishings.FinishingsStapleDualTop, finishings.FinishingsStapleDualLeft, finishings.FinishingsStapleDualRight, finishings.FinishingsStapleDualBottom},
+			{finishings.FinishingsStapleDualLeft, finishings.FinishingsStapleDualBottom, finishings.FinishingsStapleDualTop, finishings.FinishingsStapleDualRight},
+			{finishings.FinishingsStapleDualBottom, finishings.FinishingsStapleDualRight, finishings.FinishingsStapleDualLeft, finishings.FinishingsStapleDualTop},
+			{finishings.FinishingsStapleDualRight, finishings.FinishingsStapleDualTop, finishings.FinishingsStapleDualBottom, finishings.FinishingsStapleDualLeft},
+		},
+		"staple-triple": {
+			{finishings.FinishingsStapleTripleTop, finishings.FinishingsStapleTripleLeft, finishings.FinishingsStapleTripleRight, finishings.FinishingsStapleTripleBottom},
+			{finishings.FinishingsStapleTripleLeft, finishings.FinishingsStapleTripleBottom, finishings.FinishingsStapleTripleTop, finishings.FinishingsStapleTripleRight},
+			{finishings.FinishingsStapleTripleBottom, finishings.FinishingsStapleTripleRight, finishings.FinishingsStapleTripleLeft, finishings.FinishingsStapleTripleTop},
+			{finishings.FinishingsStapleTripleRight, finishings.FinishingsStapleTripleTop, finishings.FinishingsStapleTripleBottom, finishings.FinishingsStapleTripleLeft},
+		},
+		"edge-stitch": {
+			{finishings.FinishingsEdgeStitchTop, finishings.FinishingsEdgeStitchLeft, finishings.FinishingsEdgeStitchRight, finishings.FinishingsEdgeStitchBottom},
+			{finishings.FinishingsEdgeStitchLeft, finishings.FinishingsEdgeStitchBottom, finishings.FinishingsEdgeStitchTop, finishings.FinishingsEdgeStitchRight},
+			{finishings.FinishingsEdgeStitchBottom, finishings.FinishingsEdgeStitchRight, finishings.FinishingsEdgeStitchLeft, finishings.FinishingsEdgeStitchTop},
+			{finishings.FinishingsEdgeStitchRight, finishings.FinishingsEdgeStitchTop, finishings.FinishingsEdgeStitchBottom, finishings.FinishingsEdgeStitchLeft},
+		},
+		"bind": {
+			{finishings.FinishingsBindTop, finishings.FinishingsBindLeft, finishings.FinishingsBindRight, finishings.FinishingsBindBottom},
+			{finishings.FinishingsBindLeft, finishings.FinishingsBindBottom, finishings.FinishingsBindTop, finishings.FinishingsBindRight},
+			{finishings.FinishingsBindBottom, finishings.FinishingsBindRight, finishings.FinishingsBindLeft, finishings.FinishingsBindTop},
+			{finishings.FinishingsBindRight, finishings.FinishingsBindTop, finishings.FinishingsBindBottom, finishings.FinishingsBindLeft},
+		},
+		"punch": {
+			{finishings.FinishingsPunchTopLeft, finishings.FinishingsPunchBottomLeft, finishings.FinishingsPunchTopRight, finishings.FinishingsPunchBottomRight},
+			{finishings.FinishingsPunchTopRight, finishings.FinishingsPunchTopLeft, finishings.FinishingsPunchBottomRight, finishings.FinishingsPunchBottomLeft},
+			{finishings.FinishingsPunchBottomRight, finishings.FinishingsPunchTopRight, finishings.FinishingsPunchBottomLeft, finishings.FinishingsPunchTopLeft},
+			{finishings.FinishingsPunchBottomLeft, finishings.FinishingsPunchBottomRight, finishings.FinishingsPunchTopLeft, finishings.FinishingsPunchTopRight},
+		},
+		"punch-dual": {
+			{finishings.FinishingsPunchDualTop, finishings.FinishingsPunchDualLeft, finishings.FinishingsPunchDualRight, finishings.FinishingsPunchDualBottom},
+			{finishings.FinishingsPunchDualLeft, finishings.FinishingsPunchDualBottom, finishings.FinishingsPunchDualTop, finishings.FinishingsPunchDualRight},
+			{finishings.FinishingsPunchDualBottom, finishings.FinishingsPunchDualRight, finishings.FinishingsPunchDualLeft, finishings.FinishingsPunchDualTop},
+			{finishings.FinishingsPunchDualRight, finishings.FinishingsPunchDualTop, finishings.FinishingsPunchDualBottom, finishings.FinishingsPunchDualLeft},
+		},
+		"punch-triple": {
+			{finishings.FinishingsPunchTripleTop, finishings.FinishingsPunchTripleLeft, finishings.FinishingsPunchTripleRight, finishings.FinishingsPunchTripleBottom},
+			{finishings.FinishingsPunchTripleLeft, finishings.FinishingsPunchTripleBottom, finishings.FinishingsPunchTripleTop, finishings.FinishingsPunchTripleRight},
+			{finishings.FinishingsPunchTripleBottom, finishings.FinishingsPunchTripleRight, finishings.FinishingsPunchTripleLeft, finishings.FinishingsPunchTripleTop},
+			{finishings.FinishingsPunchTripleRight, finishings.FinishingsPunchTripleTop, finishings.FinishingsPunchTripleBottom, finishings.FinishingsPunchTripleLeft},
+		},
+		"punch-quad": {
+			{finishings.FinishingsPunchQuadTop, finishings.FinishingsPunchQuadLeft, finishings.FinishingsPunchQuadRight, finishings.FinishingsPunchQuadBottom},
+			{finishings.FinishingsPunchQuadLeft, finishings.FinishingsPunchQuadBottom, finishings.FinishingsPunchQuadTop, finishings.FinishingsPunchQuadRight},
+			{finishings.FinishingsPunchQuadBottom, finishings.FinishingsPunchQuadRight, finishings.FinishingsPunchQuadLeft, finishings.FinishingsPunchQuadTop},
+			{finishings.FinishingsPunchQuadRight, finishings.FinishingsPunchQuadTop, finishings.FinishingsPunchQuadBottom, finishings.FinishingsPunchQuadLeft},
+		},
+	}
+
+	for family, cases := range tests {
+		for _, test := range cases {
+			if got := rotateFinishings(test.portrait, jobticket.OrientationPortrait); got != test.portrait {
+				t.Fatalf("%s: portrait %d rotated to %d", family, test.portrait, got)
+			}
+			if got := rotateFinishings(test.portrait, jobticket.OrientationLandscape); got != test.landscape {
+				t.Fatalf("%s: landscape %d rotated to %d, expected %d", family, test.portrait, got, test.landscape)
+			}
+			if got := rotateFinishings(test.portrait, jobticket.OrientationReverseLandscape); got != test.reverseLandscape {
+				t.Fatalf("%s: reverse-landscape %d rotated to %d, expected %d", family, test.portrait, got, test.reverseLandscape)
+			}
+			if got := rotateFinishings(test.portrait, jobticket.OrientationReversePortrait); got != test.reversePortrait {
+				t.Fatalf("%s: reverse-portrait %d rotated to %d, expected %d", family, test.portrait, got, test.reversePortrait)
+			}
+		}
+	}
+}
+
+func TestRotateFinishings_NotPositional(t *testing.T) {
+	for _, enum := range []finishings.Finishings{
+		finishings.FinishingsStaple,
+		finishings.FinishingsSaddleStitch,
+		finishings.FinishingsFoldHalf,
+		finishings.FinishingsTrimAfterJob,
+	} {
+		if got := rotateFinishings(enum, jobticket.OrientationLandscape); got != enum {
+			t.Fatalf("%d is not positional, rotated to %d", enum, got)
+		}
+	}
+}
+
+func TestMapFinishingsCol_Database(t *testing.T) {
+	stapleBottomLeft := map[string]interface{}{
+		"finishing-template": "staple-bottom-left",
+		"stitching": map[string]interface{}{
+			"stitching-reference-edge": "left",
+			"stitching-locations":      []int{1000},
+		},
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		FinishingsColSupported: []string{"finishing-template", "stitching"},
+		FinishingsColDatabase: []map[string]interface{}{
+			{"finishing-template": "staple-top-left"},
+			stapleBottomLeft,
+			{"finishing-template": "punch"},
+		},
+	}
+	jobTicket := &jobticket.JobTicket{
+		Finishings: []string{"staple-top-left", "punch-dual-left", "fold-half"},
+		OptionalPDLOverrides: jobticket.PDLOverrides{
+			Orientation: jobticket.OrientationLandscape,
+		},
+	}
+
+	// staple-top-left is rotated to the database's staple-bottom-left, punch-dual-left falls back to punch
+	// and fold-half isn't supported.
+	cols := mapFinishingsCol(jobTicket, printerAttrs)
+	if len(cols) != 2 || cols[0]["stitching"] == nil || cols[1]["finishing-template"] != "punch" {
+		t.Fatalf("finishings-col were not mapped properly. Got %v", cols)
+	}
+}
+
+func TestMakeIPPJobAttributes_FinishingsCol(t *testing.T) {
+	jobTicket := &jobticket.JobTicket{
+		Copies:     1,
+		PaperName:  "A4",
+		Finishings: []string{"staple-top-left"},
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		FinishingsSupported: []int{int(finishings.FinishingsStapleTopLeft)},
+	}
+
+	jobAttrs, err := makeIPPJobAttributes(jobTicket, printerAttrs)
+	if err != nil || len(jobAttrs.Finishings) != 1 || jobAttrs.FinishingsCol != nil {
+		t.Fatalf("expected finishings enums, got %v, %v, %v", jobAttrs.Finishings, jobAttrs.FinishingsCol, err)
+	}
+
+	printerAttrs.FinishingsColSupported = []string{"finishing-template"}
+	jobAttrs, err = makeIPPJobAttributes(jobTicket, printerAttrs)
+	if err != nil || jobAttrs.Finishings != nil || len(jobAttrs.FinishingsCol) != 1 ||
+		jobAttrs.FinishingsCol[0]["finishing-template"] != "staple-top-left" {
+		t.Fatalf("expected finishings-col, got %v, %v, %v", jobAttrs.Finishings, jobAttrs.FinishingsCol, err)
+	}
+}
+
+func TestApplyOptionalJobAttributes_Supported(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		PageRanges:        "1-3, 5",
+		NumberUp:          4,
+		PrintQuality:      "high",
+		PrinterResolution: "600dpi",
+		OutputBin:         "face-down",
+		PrintScaling:      "fit",
+		JobName:           "report.pdf",
+		JobPriority:       80,
+		JobHoldUntil:      "night",
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		PageRangesSupported:        true,
+		NumberUpSupported:          []int{1, 2, 4},
+		PrintQualitySupported:      []int{4, 5},
+		PrinterResolutionSupported: []ipp.Resolution{{XRes: 600, YRes: 600, Units: 3}},
+		OutputBinSupported:         []string{"face-down"},
+		PrintScalingSupported:      []string{"auto", "fit"},
+		JobPrioritySupported:       100,
+	}
+
+	jobAttrs := &ippclient.PrintJobTemplateAttributes{}
+	applyOptionalJobAttributes(jobAttrs, ticket, printerAttrs)
+
+	if len(jobAttrs.PageRanges) != 2 || jobAttrs.PageRanges[1] != (ipp.RangeOfInteger{LowerBound: 5, UpperBound: 5}) {
+		t.Fatalf("page-ranges not mapped, got %v", jobAttrs.PageRanges)
+	}
+	if jobAttrs.NumberUp != 4 || jobAttrs.PrintQuality != 5 || jobAttrs.PrinterResolution.XRes != 600 ||
+		jobAttrs.OutputBin != "face-down" || jobAttrs.PrintScaling != "fit" || jobAttrs.JobName != "report.pdf" ||
+		jobAttrs.JobPriority != 80 {
+		t.Fatalf("job attributes not mapped, got %+v", jobAttrs)
+	}
+	// The printer doesn't list job-hold-until-supported.
+	if jobAttrs.JobHoldUntil != "" {
+		t.Fatalf("unsupported job-hold-until mapped")
+	}
+}
+
+func TestApplyOptionalJobAttributes_Unsupported(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		PageRanges:        "2",
+		NumberUp:          6,
+		PrintQuality:      "draft",
+		PrinterResolution: "1200x600dpi",
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		NumberUpSupported:          []int{1, 2, 4},
+		PrintQualitySupported:      []int{4, 5},
+		PrinterResolutionSupported: []ipp.Resolution{{XRes: 600, YRes: 600, Units: 3}},
+	}
+
+	jobAttrs := &ippclient.PrintJobTemplateAttributes{}
+	applyOptionalJobAttributes(jobAttrs, ticket, printerAttrs)
+
+	if jobAttrs.PageRanges != nil || jobAttrs.NumberUp != 0 || jobAttrs.PrintQuality != 0 || jobAttrs.PrinterResolution.XRes != 0 {
+		t.Fatalf("unsupported job attributes mapped, got %+v", jobAttrs)
+	}
+}
+
+func TestCheckTicketCompatibility_Verdicts(t *testing.T) {
+	ticket := func() *jobticket.JobTicket {
+		return &jobticket.JobTicket{
+			Copies:         1,
+			PrintColorMode: "color",
+			Sides:          "two-sided-long-edge",
+			DocumentFormat: "application/pdf",
+			PaperName:      "A4",
+			PaperWidthMM:   210,
+			PaperHeightMM:  297,
+			Finishings:     []string{"staple-top-left"},
+		}
+	}
+	printerAttrs := func() *ippclient.PrinterAttributes {
+		return &ippclient.PrinterAttributes{
+			OperationsSupported:     []int{int(ipp.OperationPrintJob), int(ipp.OperationCreateJob), int(ipp.OperationSendDocument)},
+			DocumentFormatSupported: []string{"application/pdf"},
+			SidesSupported:          []string{"one-sided", "two-sided-long-edge"},
+			PrintColorModeSupported: []string{"color", "monochrome"},
+			FinishingsSupported:     []int{int(finishings.FinishingsStaple), int(finishings.FinishingsStapleTopLeft)},
+			MediaSupported:          []string{"iso_a4_210x297mm"},
+		}
+	}
+
+	verdict := checkTicketCompatibility(ticket(), "ipp://127.0.0.1/ipp/print", printerAttrs())
+	if verdict.verdict != verdictPass || verdict.operation != "create-job/send-document" {
+		t.Fatalf("expected pass with create-job/send-document, got %+v", verdict)
+	}
+
+	degraded := printerAttrs()
+	degraded.SidesSupported = []string{"one-sided"}
+	degraded.FinishingsSupported = []int{int(finishings.FinishingsStaple)}
+	degraded.MediaSupported = []string{"na_letter_8.5x11in"}
+	verdict = checkTicketCompatibility(ticket(), "ipp://127.0.0.1/ipp/print", degraded)
+	if verdict.verdict != verdictDegraded || len(verdict.reasons) != 3 {
+		t.Fatalf("expected degraded sides, finishing and paper, got %+v", verdict)
+	}
+
+	failing := printerAttrs()
+	failing.DocumentFormatSupported = []string{"image/urf"}
+	failTicket := ticket()
+	failTicket.DocumentFormat = "application/postscript"
+	verdict = checkTicketCompatibility(failTicket, "ipp://127.0.0.1/ipp/print", failing)
+	if verdict.verdict != verdictFail {
+		t.Fatalf("expected fail, got %+v", verdict)
+	}
+
+	// Copies made by the PJL header are sent as a single copy in IPP.
+	pjlTicket := ticket()
+	pjlTicket.DocumentFormat = "application/postscript"
+	pjlTicket.Copies = 3
+	pjlTicket.OptionalPDLOverrides.PJLHeader = true
+	pjlPrinter := printerAttrs()
+	pjlPrinter.DocumentFormatSupported = []string{"application/postscript"}
+	verdict = checkTicketCompatibility(pjlTicket, "ipp://127.0.0.1/ipp/print", pjlPrinter)
+	if verdict.verdict != verdictPass {
+		t.Fatalf("expected pass with the copies in the PJL header, got %+v", verdict)
+	}
+
+	// Paper taken from the document has no size to compare with the printer's media.
+	autoTicket := ticket()
+	autoTicket.PaperName, autoTicket.PaperWidthMM, autoTicket.PaperHeightMM = jobticket.PaperNameAuto, 0, 0
+	letterPrinter := printerAttrs()
+	letterPrinter.MediaSupported = []string{"na_letter_8.5x11in"}
+	verdict = checkTicketCompatibility(autoTicket, "ipp://127.0.0.1/ipp/print", letterPrinter)
+	if verdict.verdict != verdictPass {
+		t.Fatalf("expected pass with paper taken from the document, got %+v", verdict)
+	}
+}
+
+func TestSniffDocumentFormat_Sanity(t *testing.T) {
+	tests := map[string]string{
+		"%PDF-1.7\n":                        "application/pdf",
+		"%!PS-Adobe-3.0\n":                  "application/postscript",
+		"\x1bE\x1b&l0O":                     "application/vnd.hp-PCL",
+		") HP-PCL XL;3;0;":                  "application/vnd.hp-PCLXL",
+		"UNIRAST\x00\x00\x00\x00\x01":       "image/urf",
+		"RaS2PwgRaster\x00":                 "image/pwg-raster",
+		"\xff\xd8\xff\xe0\x00\x10JFIF":      "image/jpeg",
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\rIH": "image/png",
+		"\x1b%-12345X@PJL JOB\r\n@PJL ENTER LANGUAGE = PCLXL\r\n) HP-PCL XL;": "application/vnd.hp-PCLXL",
+		"\x1b%-12345X@PJL JOB NAME=\"a\"\r\n@PJL SET COPIES=1\r\n%PDF-1.4":    "application/pdf",
+		"hello world": "",
+	}
+
+	for head, expected := range tests {
+		if format := sniffDocumentFormat([]byte(head)); format != expected {
+			t.Fatalf("sniffDocumentFormat(%q) = %q, expected %q", head, format, expected)
+		}
+	}
+}
+
+func TestReconcileDocumentFormat_Sanity(t *testing.T) {
+	ticket := &jobticket.JobTicket{DocumentFormat: "application/octet-stream"}
+	if err := reconcileDocumentFormat(ticket, []byte("%PDF-1.7"), true); err != nil || ticket.DocumentFormat != "application/pdf" {
+		t.Fatalf("expected octet-stream upgraded to application/pdf, got %v, %v", ticket.DocumentFormat, err)
+	}
+
+	ticket = &jobticket.JobTicket{DocumentFormat: "application/pcl"}
+	if err := reconcileDocumentFormat(ticket, []byte("\x1bE"), true); err != nil {
+		t.Fatalf("expected application/pcl to match PCL, got %v", err)
+	}
+
+	ticket = &jobticket.JobTicket{DocumentFormat: "application/postscript"}
+	if err := reconcileDocumentFormat(ticket, []byte("%PDF-1.7"), false); err != nil || ticket.DocumentFormat != "application/postscript" {
+		t.Fatalf("expected a warning only, got %v, %v", ticket.DocumentFormat, err)
+	}
+	err := reconcileDocumentFormat(ticket, []byte("%PDF-1.7"), true)
+	var opErr *OperationError
+	if !errors.As(err, &opErr) || opErr.Type != ErrPrintDocFormatSniffMismatch {
+		t.Fatalf("expected ErrPrintDocFormatSniffMismatch, got %v", err)
+	}
+}
+
+func TestBuildJob_Rasterise(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		Copies:         1,
+		PrintColorMode: "color",
+		Sides:          "two-sided-long-edge",
+		DocumentFormat: "image/png",
+		PaperName:      "A4",
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		DocumentFormatSupported:              []string{"application/pdf", "image/pwg-raster", "image/urf"},
+		MediaColSupported:                    []string{"media-size"},
+		PwgRasterDocumentResolutionSupported: []ipp.Resolution{{XRes: 150, YRes: 150, Units: 3}, {XRes: 118, YRes: 118, Units: 4}, {XRes: 600, YRes: 600, Units: 3}},
+		PwgRasterDocumentTypeSupported:       []string{"sgray_8", "srgb_8"},
+		PwgRasterDocumentSheetBack:           "rotated",
+		UrfSupported:                         []string{"V1.4", "W8", "RS300-600", "DM3"},
+	}
+
+	job, err := buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.docFormat != "image/pwg-raster" || job.rasterise == nil {
+		t.Fatalf("expected the image to be rasterised to pwg-raster, got %s", job.docFormat)
+	}
+	opts := job.rasterise
+	if opts.XRes != 300 || opts.YRes != 300 || opts.ColorSpace != "srgb_8" || opts.SheetBack != "rotated" ||
+		opts.MediaWidth != 21000 || opts.MediaHeight != 29700 || opts.Sides != "two-sided-long-edge" {
+		t.Fatalf("unexpected raster options: %+v", opts)
+	}
+
+	printerAttrs.DocumentFormatSupported = []string{"application/pdf", "image/urf"}
+	job, err = buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts = job.rasterise
+	if job.docFormat != "image/urf" || opts.XRes != 300 || opts.ColorSpace != "sgray_8" || opts.SheetBack != "rotated" {
+		t.Fatalf("unexpected urf raster options: %s %+v", job.docFormat, opts)
+	}
+
+	printerAttrs.DocumentFormatSupported = []string{"application/pdf", "image/png", "image/urf"}
+	job, err = buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.docFormat != "image/png" || job.rasterise != nil {
+		t.Fatalf("expected the image to be sent as is, got %s", job.docFormat)
+	}
+}
+
+func TestInspectPDF_PageTree(t *testing.T) {
+	// Pages inherit the MediaBox from the tree, the second page is rotated. The kids are out of object order.
+	pdf := `%PDF-1.4
+1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [4 0 R 3 0 R] /Count 2 /MediaBox [0 0 595.28 841.89] >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R /Rotate 90 /Contents 5 0 R >> endobj
+4 0 obj << /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >> endobj
+5 0 obj << /Length 2 >>
+stream
+q
+endstream
+endobj
+trailer << /Root 1 0 R >>
+%%EOF`
+
+	doc, err := inspectPDF([]byte(pdf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.pages) != 2 || doc.pages[0].width != 612 || doc.pages[0].height != 792 ||
+		doc.pages[1].width != 841.89 || doc.pages[1].height != 595.28 {
+		t.Fatalf("unexpected pages: %+v", doc.pages)
+	}
+
+	if _, err := inspectPDF([]byte("%PDF-1.4\n%%EOF")); err == nil {
+		t.Fatalf("expected an error for a document without pages")
+	}
+
+	// A page tree listing itself as its kids, twice, is only walked once.
+	done := make(chan error, 1)
+	go func() {
+		_, err := inspectPDF([]byte("%PDF-1.4\n1 0 obj<</Type/Pages/Kids[1 0 R 1 0 R]/Count 1>>endobj"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("expected an error for a self referencing page tree without pages")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("inspecting a self referencing page tree didn't finish")
+	}
+}
+
+func TestInspectPDF_ObjectStream(t *testing.T) {
+	objects := []string{
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 842 595] >>",
+	}
+	header := fmt.Sprintf("2 0 3 %d ", len(objects[0])+1)
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	_, _ = w.Write([]byte(header + objects[0] + " " + objects[1]))
+	_ = w.Close()
+
+	pdf := fmt.Sprintf("%%PDF-1.5\n1 0 obj << /Type /ObjStm /N 2 /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n%%%%EOF",
+		len(header), compressed.Len(), compressed.String())
+
+	doc, err := inspectPDF([]byte(pdf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.pages) != 1 || doc.pages[0].width != 842 || doc.pages[0].height != 595 {
+		t.Fatalf("unexpected pages: %+v", doc.pages)
+	}
+}
+
+func TestApplyPDFPageSize_Sanity(t *testing.T) {
+	ticket := &jobticket.JobTicket{PaperName: jobticket.PaperNameAuto}
+	applyPDFPageSize(ticket, pdfPage{width: 842, height: 595})
+	if ticket.PaperName != "iso_a4_210x297mm" || ticket.PaperWidthMM != 210 || ticket.PaperHeightMM != 297 ||
+		ticket.OptionalPDLOverrides.Orientation != jobticket.OrientationLandscape {
+		t.Fatalf("unexpected ticket: %+v", ticket)
+	}
+
+	ticket = &jobticket.JobTicket{PaperName: jobticket.PaperNameAuto}
+	applyPDFPageSize(ticket, pdfPage{width: 226.77, height: 566.93})
+	if ticket.PaperName != "custom_80x200mm_80x200mm" || ticket.OptionalPDLOverrides.Orientation != jobticket.OrientationPortrait {
+		t.Fatalf("unexpected ticket: %+v", ticket)
+	}
+
+	// The ticket's paper and orientation are left alone.
+	ticket = &jobticket.JobTicket{PaperName: "Letter", PaperWidthMM: 216, PaperHeightMM: 279,
+		OptionalPDLOverrides: jobticket.PDLOverrides{Orientation: jobticket.OrientationPortrait}}
+	applyPDFPageSize(ticket, pdfPage{width: 842, height: 595})
+	if ticket.PaperName != "Letter" || ticket.OptionalPDLOverrides.Orientation != jobticket.OrientationPortrait {
+		t.Fatalf("unexpected ticket: %+v", ticket)
+	}
+}
+
+func TestInjectPJLHeader_Sanity(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		Copies:               2,
+		PrintColorMode:       "monochrome",
+		Sides:                "two-sided-short-edge",
+		DocumentFormat:       "application/postscript",
+		JobName:              `report "q3"`,
+		OptionalPDLOverrides: jobticket.PDLOverrides{Orientation: jobticket.OrientationReverseLandscape, PJLHeader: true},
+	}
+	if !injectsPJLHeader(ticket) {
+		t.Fatalf("expected a PJL header for postscript")
+	}
+
+	out, err := io.ReadAll(injectPJLHeader(ticket, bufio.NewReader(strings.NewReader("%!PS\nshowpage\n"))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "\x1b%-12345X@PJL JOB NAME=\"report q3\"\r\n" +
+		"@PJL SET DUPLEX=ON\r\n@PJL SET BINDING=SHORTEDGE\r\n@PJL SET ORIENTATION=LANDSCAPE\r\n" +
+		"@PJL SET RENDERMODE=GRAYSCALE\r\n@PJL SET COPIES=2\r\n@PJL ENTER LANGUAGE=POSTSCRIPT\r\n" +
+		"%!PS\nshowpage\n\x1b%-12345X@PJL EOJ NAME=\"report q3\"\r\n\x1b%-12345X"
+	if string(out) != expected {
+		t.Fatalf("unexpected document:\n%q\nexpected:\n%q", out, expected)
+	}
+
+	// The settings go into the document's own header.
+	ticket.DocumentFormat = "application/vnd.hp-PCL"
+	ticket.Sides = "one-sided"
+	ticket.Copies = 1
+	ticket.OptionalPDLOverrides.Orientation = ""
+	document := "\x1b%-12345X@PJL JOB\r\n@PJL ENTER LANGUAGE=PCL\r\n\x1bE..."
+	out, err = io.ReadAll(injectPJLHeader(ticket, bufio.NewReader(strings.NewReader(document))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "\x1b%-12345X@PJL JOB\r\n@PJL SET DUPLEX=OFF\r\n@PJL SET RENDERMODE=GRAYSCALE\r\n@PJL ENTER LANGUAGE=PCL\r\n\x1bE..."
+	if string(out) != expected {
+		t.Fatalf("unexpected document:\n%q\nexpected:\n%q", out, expected)
+	}
+
+	ticket.DocumentFormat = "application/pdf"
+	if injectsPJLHeader(ticket) {
+		t.Fatalf("expected no PJL header for pdf")
+	}
+}
+
+func TestBuildJob_PJLHeaderCopies(t *testing.T) {
+	ticket := &jobticket.JobTicket{
+		Copies:               3,
+		PrintColorMode:       "color",
+		Sides:                "one-sided",
+		DocumentFormat:       "application/vnd.hp-PCL",
+		PaperName:            "A4",
+		EmulateCopiesFormats: []string{"*"},
+		OptionalPDLOverrides: jobticket.PDLOverrides{PJLHeader: true},
+	}
+	printerAttrs := &ippclient.PrinterAttributes{
+		DocumentFormatSupported: []string{"application/vnd.hp-PCL"},
+	}
+
+	job, err := buildJob(ticket, printerAttrs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if job.emulatedCopies != 1 || job.template.AttributeCopies != 1 {
+		t.Fatalf("expected the PJL header to make the copies, got %d emulated, %d copies", job.emulatedCopies, job.template.AttributeCopies)
+	}
+}
+
+func TestSelectCompression_Sanity(t *testing.T) {
+	printerAttrs := &ippclient.PrinterAttributes{CompressionSupported: []string{"none", "deflate", "gzip"}}
+	tests := []struct {
+		mode, format, expected string
+	}{
+		{"none", "application/pdf", "none"},
+		{"auto", "application/pdf", "gzip"},
+		{"deflate", "application/pdf", "deflate"},
+		{"compress", "application/pdf", "none"},
+		{"auto", "image/jpeg", "none"},
+	}
+	for _, test := range tests {
+		if compression := selectCompression(printerAttrs, test.format, test.mode); compression != test.expected {
+			t.Fatalf("%s %s: expected %s, got %s", test.mode, test.format, test.expected, compression)
+		}
+	}
+
+	if compression := selectCompression(&ippclient.PrinterAttributes{}, "application/pdf", "auto"); compression != "none" {
+		t.Fatalf("expected no compression when the printer doesn't support any, got %s", compression)
+	}
+}
+
+func TestCompressDocument_RoundTrip(t *testing.T) {
+	document := strings.Repeat("%PDF-1.7 compressible ", 1000)
+	compressed := compressDocument(strings.NewReader(document), "gzip")
+	data, err := io.ReadAll(compressed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = compressed.Close()
+	if compressed.in != int64(len(document)) || compressed.out != int64(len(data)) || compressed.out >= compressed.in {
+		t.Fatalf("unexpected counts: in=%d out=%d", compressed.in, compressed.out)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decompressed, err := io.ReadAll(r)
+	if err != nil || string(decompressed) != document {
+		t.Fatalf("document didn't survive compression: %v", err)
+	}
+
+	// Closing before the document is read stops the compression.
+	compressed = compressDocument(strings.NewReader(document), "deflate")
+	if err := compressed.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUploadTimeout_Sanity(t *testing.T) {
+	if timeout := uploadTimeout(10*1024*1024, 30*time.Second, 8*1024); timeout != 30*time.Second+1280*time.Second {
+		t.Fatalf("unexpected timeout %v", timeout)
+	}
+	if timeout := uploadTimeout(-1, 30*time.Second, 8*1024); timeout != 30*time.Second {
+		t.Fatalf("expected the request timeout for an unknown size, got %v", timeout)
+	}
+	if timeout := uploadTimeout(1024, 30*time.Second, 0); timeout != 0 {
+		t.Fatalf("expected no timeout without a minimum throughput, got %v", timeout)
+	}
+}
+
+type slowReader struct{}
+
+func (slowReader) Read(b []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	b[0] = 'x'
+	return 1, nil
+}
+
+func TestUploadProgress_TooSlow(t *testing.T) {
+	progress := &uploadProgress{
+		Reader:        io.LimitReader(slowReader{}, 100),
+		operation:     sendDocumentOperation,
+		attempt:       1,
+		size:          100,
+		grace:         50 * time.Millisecond,
+		minThroughput: 1024,
+		start:         time.Now(),
+	}
+
+	_, err := io.ReadAll(progress)
+	var tooSlow *errUploadTooSlow
+	if !errors.As(err, &tooSlow) || tooSlow.Temporary() {
+		t.Fatalf("expected errUploadTooSlow, got %v", err)
+	}
+	if progress.sent < 3 || progress.sent >= 100 {
+		t.Fatalf("expected the upload to stop after the grace period, sent %d", progress.sent)
+	}
+
+	progress = &uploadProgress{Reader: strings.NewReader("document"), size: 8, minThroughput: 1024, start: time.Now()}
+	if data, err := io.ReadAll(progress); err != nil || string(data) != "document" || progress.sent != 8 {
+		t.Fatalf("unexpected upload: %q %v", data, err)
+	}
+}
+
+func TestSpoolPolicy_Strategies(t *testing.T) {
+	dir := t.TempDir()
+	small, large := "small document", strings.Repeat("large document ", 100)
+
+	// Small documents stay in memory.
+	policy := &spoolPolicy{strategy: spoolStrategyAuto, memoryLimit: 64}
+	docReader, cleanup, err := policy.spool(dir, strings.NewReader(small), -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := docReader.(*memoryReader); !ok || docReader.Size() != int64(len(small)) {
+		t.Fatalf("expected a memory spool, got %T", docReader)
+	}
+	cleanup()
+
+	// Larger ones go to an encrypted spool file, removed by cleanup.
+	policy.encrypt = true
+	docReader, cleanup, err = policy.spool(dir, strings.NewReader(large), -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ := io.ReadAll(docReader)
+	if string(data) != large {
+		t.Fatalf("unexpected document read while spooling")
+	}
+	spool := docReader.(*streamReader).spool
+	onDisk, _ := os.ReadFile(spool.file.Name())
+	if len(onDisk) != len(large) || strings.Contains(string(onDisk), "large document") {
+		t.Fatalf("expected the spool file to be encrypted")
+	}
+	docReader, err = docReader.Reset()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, _ = io.ReadAll(docReader)
+	if string(data) != large || docReader.Size() != int64(len(large)) {
+		t.Fatalf("unexpected document read from the spool file")
+	}
+	cleanup()
+	if _, err := os.Stat(spool.file.Name()); !os.IsNotExist(err) {
+		t.Fatalf("expected the spool file to be removed, got %v", err)
+	}
+
+	// Documents over the memory limit or the quota fail.
+	policy = &spoolPolicy{strategy: spoolStrategyMemory, memoryLimit: 64}
+	var opErr *OperationError
+	if _, _, err := policy.spool(dir, strings.NewReader(large), -1); !errors.As(err, &opErr) || opErr.Type != ErrPrintSpool {
+		t.Fatalf("expected ErrPrintSpool, got %v", err)
+	}
+	// The quota fails a document of known size up front, and one of unknown size once spooled, before it's sent.
+	policy = &spoolPolicy{strategy: spoolStrategyDisk, quota: 100}
+	if _, _, err := policy.spool(dir, strings.NewReader(large), int64(len(large))); !errors.As(err, &opErr) || opErr.Type != ErrPrintSpool {
+		t.Fatalf("expected ErrPrintSpool for a known size over the quota, got %v", err)
+	}
+	if _, _, err := policy.spool(dir, strings.NewReader(large), -1); !errors.As(err, &opErr) || opErr.Type != ErrPrintSpool {
+		t.Fatalf("expected ErrPrintSpool for an unknown size over the quota, got %v", err)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(dir, spoolFilePrefix+"*")); len(leftover) != 0 {
+		t.Fatalf("expected failed spool files to be removed, got %v", leftover)
+	}
+	docReader, cleanup, err = policy.spool(dir, strings.NewReader(small), -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := docReader.(*fileReader); !ok || docReader.Size() != int64(len(small)) {
+		t.Fatalf("expected a document of unknown size to be completely spooled, got %T", docReader)
+	}
+	cleanup()
+	docReader, cleanup, err = policy.spool(dir, strings.NewReader(small), int64(len(small)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := docReader.(*streamReader); !ok {
+		t.Fatalf("expected a document of known size within the quota to be streamed, got %T", docReader)
+	}
+	cleanup()
+
+	// Streamed documents can't be read twice.
+	policy = &spoolPolicy{strategy: spoolStrategyStream}
+	docReader, _, _ = policy.spool(dir, strings.NewReader(small), -1)
+	if _, err := docReader.Reset(); err != nil {
+		t.Fatalf("expected an unread stream to reset, got %v", err)
+	}
+	_, _ = io.ReadAll(docReader)
+	if _, err := docReader.Reset(); err != errNotSpooled {
+		t.Fatalf("expected errNotSpooled, got %v", err)
+	}
+}
+
+func TestSweepSpool_RemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// A live spool file holds its lock.
+	policy := &spoolPolicy{strategy: spoolStrategyDisk}
+	docReader, cleanup, err := policy.spool(dir, strings.NewReader("live document"), -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _ = io.ReadAll(docReader)
+	live := docReader.(*streamReader).spool.file.Name()
+
+	orphan := filepath.Join(dir, spoolFilePrefix+"orphan")
+	if err := os.WriteFile(orphan, []byte("orphaned document"), 0600); err != nil {
+		t.Fatalf("failed to write spool file: %v", err)
+	}
+	if err := os.WriteFile(orphan+spoolLockSuffix, nil, 0644); err != nil {
+		t.Fatalf("failed to write lock file: %v", err)
+	}
+	recent := filepath.Join(dir, spoolFilePrefix+"recent")
+	if err := os.WriteFile(recent, []byte("recent document"), 0600); err != nil {
+		t.Fatalf("failed to write spool file: %v", err)
+	}
+	old := now.Add(-2 * time.Hour)
+	for _, path := range []string{live, orphan, orphan + spoolLockSuffix} {
+		_ = os.Chtimes(path, old, old)
+	}
+
+	sweep, err := sweepSpool(dir, time.Hour, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sweep.removed != 1 || sweep.reclaimed != int64(len("orphaned document")) || sweep.inUse != 1 || sweep.kept != 1 {
+		t.Fatalf("unexpected sweep: %+v", sweep)
+	}
+	for _, path := range []string{orphan, orphan + spoolLockSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %v to be removed, got %v", path, err)
+		}
+	}
+	for _, path := range []string{live, recent} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %v to be kept, got %v", path, err)
+		}
+	}
+
+	// Once released the live spool file goes with its lock file.
+	cleanup()
+	for _, path := range []string{live, live + spoolLockSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %v to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestOperationChain_Fallback(t *testing.T) {
+	defer func(chain string) { *ippOperationChain = chain }(*ippOperationChain)
+
+	printerAttrs := &ippclient.PrinterAttributes{
+		OperationsSupported: []int{int(ipp.OperationPrintJob), int(ipp.OperationCreateJob), int(ipp.OperationSendDocument), int(ipp.OperationPrintURI)},
+	}
+
+	// Operations the printer doesn't list are skipped, unknown ones ignored.
+	*ippOperationChain = "send-uri, create-job,bogus,print-uri,print-job,create-job"
+	chain := operationChain("ipp://127.0.0.1/ipp/print", printerAttrs)
+	if strings.Join(chain, ",") != "create-job,print-uri,print-job" {
+		t.Fatalf("unexpected operation chain: %v", chain)
+	}
+
+	// Print-Job is the one operation tried without the printer listing it.
+	chain = operationChain("ipp://127.0.0.1/ipp/print", &ippclient.PrinterAttributes{})
+	if strings.Join(chain, ",") != "print-job" {
+		t.Fatalf("unexpected operation chain with no operations-supported: %v", chain)
+	}
+
+	// Documents sent to a printer over TLS aren't served over plain HTTP.
+	chain = operationChain("ipps://127.0.0.1/ipp/print", printerAttrs)
+	if strings.Join(chain, ",") != "create-job,print-job" {
+		t.Fatalf("unexpected operation chain for an ipps printer: %v", chain)
+	}
+
+	tests := []struct {
+		err       error
+		operation string
+		expected  bool
+	}{
+		{&OperationError{Type: ErrPrintJobCreation, Err: fmt.Errorf("ipp Create-Job failed: %w",
+			&ippStatusError{operation: createJobOperation, status: statusErrorOperationNotSupported})}, createJobOperation, true},
+		{&ippStatusError{operation: printJobOperation, status: statusErrorOperationNotSupported}, printJobOperation, true},
+		{&ippStatusError{operation: printURIOperation, status: statusErrorDocumentAccessError}, printURIOperation, true},
+		{&ippStatusError{operation: sendURIOperation, status: statusErrorURISchemeNotSupported}, sendURIOperation, true},
+		{&ippStatusError{operation: printJobOperation, status: statusErrorURISchemeNotSupported}, printJobOperation, false},
+		{&ippStatusError{operation: createJobOperation, status: statusErrorAttributesOrValuesNotSupported}, createJobOperation, false},
+		{&documentServerError{err: errors.New("no route")}, printURIOperation, true},
+		{&OperationError{Type: ErrPrintJobSendDocument, Err: &retriesExhaustedError{operation: createJobOperation,
+			attempts: maxPrintLoops, err: errors.New("busy")}}, createJobOperation, true},
+		{&retriesExhaustedError{operation: printJobOperation, attempts: maxPrintLoops, err: errors.New("busy")}, printJobOperation, false},
+		{errors.New("connection reset"), createJobOperation, false},
+	}
+	for i, tc := range tests {
+		if got := fallsBackToNextOperation(tc.err, tc.operation); got != tc.expected {
+			t.Fatalf("test %d: expected fallback %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestOperationChain_CreateJobRetriesExhausted(t *testing.T) {
+	defer func(senders map[string]func(*ippPrinter, context.Context, *ippclient.PrintJobTemplateAttributes, string, readCloseResetter, string) (*ippclient.JobAttributes, error)) {
+		operationSenders = senders
+	}(operationSenders)
+
+	// Create-Job keeps failing with temporary errors, Print-Job works.
+	var sent []string
+	operationSenders = map[string]func(*ippPrinter, context.Context, *ippclient.PrintJobTemplateAttributes, string, readCloseResetter, string) (*ippclient.JobAttributes, error){
+		createJobOperation: func(*ippPrinter, context.Context, *ippclient.PrintJobTemplateAttributes, string, readCloseResetter, string) (*ippclient.JobAttributes, error) {
+			sent = append(sent, createJobOperation)
+			return nil, &OperationError{Type: ErrPrintJobCreation, Err: &retriesExhaustedError{operation: createJobOperation,
+				attempts: maxPrintLoops, err: errors.New("server-error-busy")}}
+		},
+		printJobOperation: func(*ippPrinter, context.Context, *ippclient.PrintJobTemplateAttributes, string, readCloseResetter, string) (*ippclient.JobAttributes, error) {
+			sent = append(sent, printJobOperation)
+			return &ippclient.JobAttributes{JobId: 1}, nil
+		},
+	}
+
+	printerURI := "ipp://127.0.0.1/ipp/print"
+	printerAttrs := &ippclient.PrinterAttributes{}
+	printer := &ippPrinter{}
+	operation, err := printer.sendJob(context.Background(), []string{createJobOperation, printJobOperation}, &ippclient.PrintJobTemplateAttributes{},
+		printerURI, &memoryReader{bytes.NewReader([]byte("%PDF-1.4 document"))}, "application/pdf")
+	if err != nil || operation != printJobOperation || strings.Join(sent, ",") != "create-job,print-job" {
+		t.Fatalf("expected the job sent with print-job after create-job, got %v %v (sent %v)", operation, err, sent)
+	}
+
+	attribCache, err := printerattributecache.NewCache(60, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create the cache: %v", err)
+	}
+	rememberBehaviour(attribCache, printerURI, printer, printerAttrs)
+	learned := learnedBehaviour(attribCache, printerURI, printerAttrs)
+	if learned == nil || learned.Operation != printJobOperation {
+		t.Fatalf("expected print-job to be learned, got %+v", learned)
+	}
+}
+
+func TestDocumentServer_ServesUntilFetched(t *testing.T) {
+	defer func(address string) { *ippDocumentServerAddress = address }(*ippDocumentServerAddress)
+	*ippDocumentServerAddress = "127.0.0.1:0"
+
+	document := "%PDF-1.4 document"
+	server, err := serveDocument("ipp://127.0.0.1/ipp/print", &memoryReader{bytes.NewReader([]byte(document))}, "application/pdf", time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer server.close()
+
+	// Only the random path serves the document.
+	resp, err := http.Get(strings.TrimSuffix(server.url, server.path) + "/other")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for another path, got %v", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.wait(ctx); err == nil {
+		t.Fatalf("expected to wait until the document is fetched")
+	}
+
+	// Every fetch gets the whole document.
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.url)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(data) != document || resp.Header.Get("Content-Type") != "application/pdf" {
+			t.Fatalf("unexpected document fetched: %q %v", data, resp.Header)
+		}
+	}
+	if err := server.wait(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A printer that doesn't fetch the document in time falls back to the next operation.
+	unfetched, err := serveDocument("ipp://127.0.0.1/ipp/print", &memoryReader{bytes.NewReader([]byte(document))}, "application/pdf", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer unfetched.close()
+	err = unfetched.wait(context.Background())
+	var serverErr *documentServerError
+	if !errors.As(err, &serverErr) || !fallsBackToNextOperation(err, printURIOperation) {
+		t.Fatalf("expected a document server error, got %v", err)
+	}
+}
+
+func TestLearnedBehaviour_Preferences(t *testing.T) {
+	learned := &printerattributecache.Behaviour{Operation: printJobOperation, DocumentFormat: "image/urf"}
+
+	chain := preferLearnedOperation([]string{createJobOperation, printURIOperation, printJobOperation}, learned)
+	if strings.Join(chain, ",") != "print-job,create-job,print-uri" {
+		t.Fatalf("unexpected operation chain: %v", chain)
+	}
+	chain = preferLearnedOperation([]string{createJobOperation}, learned)
+	if strings.Join(chain, ",") != "create-job" {
+		t.Fatalf("expected a learned operation missing from the chain to be ignored, got %v", chain)
+	}
+
+	ticket := &jobticket.JobTicket{DocumentFormat: "application/postscript", AltDocumentFormat: []string{"image/pwg-raster", "image/urf"}}
+	printerAttrs := &ippclient.PrinterAttributes{DocumentFormatSupported: []string{"image/pwg-raster", "image/urf"}}
+	if format := mapDocumentFormat(preferLearnedDocumentFormat(ticket, printerAttrs, learned), printerAttrs); format != "image/urf" {
+		t.Fatalf("expected the learned document format, got %v", format)
+	}
+	if format := mapDocumentFormat(preferLearnedDocumentFormat(ticket, printerAttrs, nil), printerAttrs); format != "image/pwg-raster" {
+		t.Fatalf("expected the first supported alternate format, got %v", format)
+	}
+	printerAttrs.DocumentFormatSupported = []string{"image/pwg-raster"}
+	if format := mapDocumentFormat(preferLearnedDocumentFormat(ticket, printerAttrs, learned), printerAttrs); format != "image/pwg-raster" {
+		t.Fatalf("expected a learned format the printer dropped to be ignored, got %v", format)
+	}
+
+	if credentialsPath(defaultIppCredentials) != credentialsDefault || credentialsPath(nil) != credentialsNone ||
+		credentialsPath(&ippclient.IPPCredentials{Username: "user", Password: "secret"}) != credentialsTicket {
+		t.Fatalf("unexpected credentials paths")
+	}
+
+	ticketCreds := &ippclient.IPPCredentials{Username: "user", Password: "secret"}
+	learned.Credentials = credentialsDefault
+	if learnedCredentials(nil, learned) != defaultIppCredentials || learnedCredentials(ticketCreds, learned) != ticketCreds ||
+		learnedCredentials(nil, nil) != nil {
+		t.Fatalf("expected the learned default credentials only without the ticket's own")
+	}
+	if usesLearnedCredentials(&ippPrinter{learned: learned, Credentials: ticketCreds}) ||
+		!usesLearnedCredentials(&ippPrinter{learned: learned, Credentials: defaultIppCredentials}) ||
+		usesLearnedCredentials(&ippPrinter{learned: &printerattributecache.Behaviour{Operation: printJobOperation}}) {
+		t.Fatalf("expected learned credentials in use only when they were applied")
+	}
+
+	if !rejectedByPrinter(&OperationError{Type: ErrPrintIPPPrintJob, Err: fmt.Errorf("print-job failed: %w",
+		&ippStatusError{operation: printJobOperation, status: 0x0400})}) ||
+		!rejectedByPrinter(&OperationError{Type: ErrPrintUnauthorised}) {
+		t.Fatalf("expected printer rejections")
+	}
+	if rejectedByPrinter(&OperationError{Type: ErrPrintSpool, Err: fmt.Errorf("over the spool quota")}) ||
+		rejectedByPrinter(fmt.Errorf("dial tcp: connection refused")) {
+		t.Fatalf("expected spool and transport errors not to be printer rejections")
+	}
+}
+
+func TestProbeCredentials_Operation(t *testing.T) {
+	printerAttrs := &ippclient.PrinterAttributes{
+		OperationsSupported: []int{int(ipp.OperationPrintJob), int(ipp.OperationValidateJob)},
+	}
+	if operation := probeOperation(printerAttrs); operation != validateJobOperation {
+		t.Fatalf("expected Validate-Job when the printer supports it, got %v", operation)
+	}
+	printerAttrs.OperationsSupported = []int{int(ipp.OperationPrintJob)}
+	if operation := probeOperation(printerAttrs); operation != getPrinterAttrsOperation {
+		t.Fatalf("expected Get-Printer-Attributes without Validate-Job, got %v", operation)
+	}
+}
+
+func TestProbeCredentials_Unauthorised(t *testing.T) {
+	defer func(attempts int) { *ippMaxUnauthorisedAttempts = attempts }(*ippMaxUnauthorisedAttempts)
+	*ippMaxUnauthorisedAttempts = 0
+	unauthorised := &ippclient.HTTPStatusError{StatusCode: http.StatusUnauthorized}
+
+	// HTTP 401, then accepted with the default credentials.
+	var sent []*ippclient.IPPCredentials
+	printer := &ippPrinter{}
+	err := printer.settleCredentials(context.Background(), validateJobOperation, func(credentials *ippclient.IPPCredentials) error {
+		sent = append(sent, credentials)
+		if credentials == nil {
+			return unauthorised
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the default credentials to be accepted, got %v", err)
+	}
+	if len(sent) != 2 || sent[0] != nil || sent[1] != defaultIppCredentials || printer.Credentials != defaultIppCredentials {
+		t.Fatalf("expected a retry with the default credentials, sent %v, settled on %v", sent, printer.Credentials)
+	}
+
+	// The ticket's own credentials fall back to the default credentials too, as Print-Job does.
+	ticketCreds := &ippclient.IPPCredentials{Username: "user", Password: "stale"}
+	sent = nil
+	printer = &ippPrinter{Credentials: ticketCreds}
+	err = printer.settleCredentials(context.Background(), validateJobOperation, func(credentials *ippclient.IPPCredentials) error {
+		sent = append(sent, credentials)
+		if credentials != defaultIppCredentials {
+			return unauthorised
+		}
+		return nil
+	})
+	if err != nil || len(sent) != 2 || sent[0] != ticketCreds || printer.Credentials != defaultIppCredentials {
+		t.Fatalf("expected stale ticket credentials to fall back to the default credentials, got %v, sent %v", err, sent)
+	}
+
+	// HTTP 401 both times fails the job before the document is sent, exiting with ErrPrintUnauthorised.
+	printer = &ippPrinter{}
+	err = printer.settleCredentials(context.Background(), validateJobOperation, func(*ippclient.IPPCredentials) error {
+		return unauthorised
+	})
+	var opErr *OperationError
+	if !errors.As(err, &opErr) || opErr.Type != ErrPrintUnauthorised {
+		t.Fatalf("expected exit code %d, got %v", ErrPrintUnauthorised, err)
+	}
+
+	// An inconclusive probe leaves the job to handle the failure itself.
+	ticketCreds = &ippclient.IPPCredentials{Username: "user", Password: "secret"}
+	printer = &ippPrinter{Credentials: ticketCreds}
+	err = printer.settleCredentials(context.Background(), getPrinterAttrsOperation, func(*ippclient.IPPCredentials) error {
+		return fmt.Errorf("dial tcp: connection refused")
+	})
+	if err != nil || printer.Credentials != ticketCreds {
+		t.Fatalf("expected an inconclusive probe not to block the job, got %v with %v", err, printer.Credentials)
+	}
+}
+
+func TestValidateFlags_Enums(t *testing.T) {
+	defer func(strategy, mode string) { *spoolStrategy, *capabilityMode = strategy, mode }(*spoolStrategy, *capabilityMode)
+
+	if err := validateFlags(); err != nil {
+		t.Fatalf("expected the default flags to be valid, got %v", err)
+	}
+
+	*spoolStrategy = spoolStrategyStream
+	*capabilityMode = "Strict"
+	var opErr *OperationError
+	if err := validateFlags(); !errors.As(err, &opErr) || opErr.Type != ErrInvalidArgs || !strings.Contains(err.Error(), "-capabilityMode") {
+		t.Fatalf("expected ErrInvalidArgs for -capabilityMode, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package ippprintclient
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/ipp/v2"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+const documentFormatPDF = "application/pdf"
+
+// PDFs larger than this aren't inspected, the whole document is read into memory.
+const pdfInspectLimit = 64 << 20
+
+// Pages beyond this aren't inspected, a malformed page tree could otherwise list pages without end.
+const pdfInspectMaxPages = 100000
+
+// Hundredths of a millimetre per PDF point.
+const pdfPointSize = 2540.0 / 72
+
+var (
+	pdfObjectRegex     = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfReferenceRegex  = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	pdfTypePageRegex   = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfTypePagesRegex  = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfTypeObjStmRegex = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+	pdfKidsRegex       = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+	pdfParentRegex     = regexp.MustCompile(`/Parent\s+(\d+)\s+\d+\s+R\b`)
+	pdfMediaBoxRegex   = regexp.MustCompile(`/MediaBox\s*\[\s*(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s*\]`)
+	pdfRotateRegex     = regexp.MustCompile(`/Rotate\s+(-?\d+)`)
+	pdfFirstRegex      = regexp.MustCompile(`/First\s+(\d+)`)
+	pdfCountRegex      = regexp.MustCompile(`/N\s+(\d+)`)
+)
+
+// pdfPage A page's size in points as it is displayed, i.e. with its rotation applied.
+type pdfPage struct {
+	width, height float64
+}
+
+// pdfDocument What inspection found out about a PDF.
+type pdfDocument struct {
+	pages []pdfPage
+}
+
+// inspectPDF Read the page count and page sizes of a PDF. Page dictionaries are found in the document body and in
+// Flate compressed object streams, and walked in page tree order. Pages inherit MediaBox and Rotate from the tree.
+// Each node of the tree is visited once, so a tree that refers back to itself can't keep the walk going.
+func inspectPDF(data []byte) (*pdfDocument, error) {
+	objects := pdfObjects(data)
+
+	var pageIDs []int
+	visited := make(map[int]bool)
+	var walk func(id int, depth int)
+	walk = func(id int, depth int) {
+		dict, ok := objects[id]
+		if !ok || depth > 64 || visited[id] || len(pageIDs) >= pdfInspectMaxPages {
+			return
+		}
+		visited[id] = true
+		if pdfTypePageRegex.Match(dict) {
+			pageIDs = append(pageIDs, id)
+			return
+		}
+		if kids := pdfKidsRegex.FindSubmatch(dict); kids != nil {
+			for _, ref := range pdfReferenceRegex.FindAllSubmatch(kids[1], -1) {
+				kid, _ := strconv.Atoi(string(ref[1]))
+				walk(kid, depth+1)
+			}
+		}
+	}
+	for id, dict := range objects {
+		if pdfTypePagesRegex.Match(dict) && !pdfParentRegex.Match(dict) {
+			walk(id, 0)
+			break
+		}
+	}
+	if len(pageIDs) == 0 {
+		return nil, fmt.Errorf("no pages found")
+	}
+
+	doc := &pdfDocument{}
+	for _, id := range pageIDs {
+		mediaBox, rotate := pdfInheritedValue(objects, id, pdfMediaBoxRegex), pdfInheritedValue(objects, id, pdfRotateRegex)
+		var page pdfPage
+		if mediaBox != nil {
+			var box [4]float64
+			for i := range box {
+				box[i], _ = strconv.ParseFloat(string(mediaBox[i+1]), 64)
+			}
+			page.width, page.height = math.Abs(box[2]-box[0]), math.Abs(box[3]-box[1])
+		}
+		if rotate != nil {
+			if degrees, _ := strconv.Atoi(string(rotate[1])); ((degrees%360)+360)%180 == 90 {
+				page.width, page.height = page.height, page.width
+			}
+		}
+		doc.pages = append(doc.pages, page)
+	}
+	return doc, nil
+}
+
+// pdfInheritedValue Match the regex against a page and then its ancestors in the page tree.
+func pdfInheritedValue(objects map[int][]byte, id int, regex *regexp.Regexp) [][]byte {
+	for depth := 0; depth < 64; depth++ {
+		dict, ok := objects[id]
+		if !ok {
+			return nil
+		}
+		if match := regex.FindSubmatch(dict); match != nil {
+			return match
+		}
+		parent := pdfParentRegex.FindSubmatch(dict)
+		if parent == nil {
+			return nil
+		}
+		id, _ = strconv.Atoi(string(parent[1]))
+	}
+	return nil
+}
+
+// pdfObjects The dictionaries of the document's objects by object number, the last definition winning as in
+// incrementally updated documents. Stream data is left out.
+func pdfObjects(data []byte) map[int][]byte {
+	objects := make(map[int][]byte)
+	for _, match := range pdfObjectRegex.FindAllSubmatchIndex(data, -1) {
+		id, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+		body := data[match[1]:]
+		if end := bytes.Index(body, []byte("endobj")); end >= 0 {
+			body = body[:end]
+		}
+
+		stream := bytes.Index(body, []byte("stream"))
+		if stream < 0 {
+			objects[id] = body
+			continue
+		}
+		dict := body[:stream]
+		objects[id] = dict
+		if pdfTypeObjStmRegex.Match(dict) {
+			for streamID, streamDict := range pdfObjectStream(dict, body[stream+len("stream"):]) {
+				objects[streamID] = streamDict
+			}
+		}
+	}
+	return objects
+}
+
+// pdfObjectStream The objects in a Flate compressed object stream, nil if it can't be read.
+func pdfObjectStream(dict, stream []byte) map[int][]byte {
+	if !bytes.Contains(dict, []byte("/FlateDecode")) {
+		return nil
+	}
+	stream = bytes.TrimLeft(stream, "\r\n")
+	if end := bytes.LastIndex(stream, []byte("endstream")); end >= 0 {
+		stream = stream[:end]
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	// A truncated stream still holds the objects before the damage.
+	content, _ := io.ReadAll(io.LimitReader(r, pdfInspectLimit))
+
+	first, count := pdfFirstRegex.FindSubmatch(dict), pdfCountRegex.FindSubmatch(dict)
+	if first == nil || count == nil {
+		return nil
+	}
+	firstOffset, _ := strconv.Atoi(string(first[1]))
+	n, _ := strconv.Atoi(string(count[1]))
+	if firstOffset > len(content) {
+		return nil
+	}
+
+	header := bytes.Fields(content[:firstOffset])
+	objects := make(map[int][]byte, n)
+	for i := 0; i < n && 2*i+1 < len(header); i++ {
+		id, _ := strconv.Atoi(string(header[2*i]))
+		start, _ := strconv.Atoi(string(header[2*i+1]))
+		end := len(content) - firstOffset
+		if 2*i+3 < len(header) {
+			end, _ = strconv.Atoi(string(header[2*i+3]))
+		}
+		if start < 0 || start > end || firstOffset+end > len(content) {
+			continue
+		}
+		objects[id] = content[firstOffset+start : firstOffset+end]
+	}
+	return objects
+}
+
+// inspectSpooledPDF Inspect the spooled PDF and fill in the ticket's orientation and media from its first page if the
+// ticket leaves them to the document. The page count goes to the processing report. Inspection is best effort, a
+// document that can't be inspected is printed as the ticket says. Returns the document reset to its start.
+func inspectSpooledPDF(ticketAttrs *jobticket.JobTicket, docReader readCloseResetter) (readCloseResetter, error) {
+	data, err := io.ReadAll(io.LimitReader(docReader, pdfInspectLimit+1))
+	if err != nil {
+		return nil, &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to read document: %v", err),
+		}
+	}
+	docReader, err = docReader.Reset()
+	if err != nil {
+		return nil, &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to read document: %v", err),
+		}
+	}
+
+	if len(data) > pdfInspectLimit {
+		pclog.Supportf("pdf larger than %d bytes, not inspected", pdfInspectLimit)
+		return docReader, nil
+	}
+	doc, err := inspectPDF(data)
+	if err != nil {
+		pclog.Supportf("failed to inspect pdf: %v", err)
+		return docReader, nil
+	}
+
+	processingLogger.LogOperationAttempt(printJobOperation, 1, fmt.Sprintf("pdf page count: %d", len(doc.pages)), "")
+	applyPDFPageSize(ticketAttrs, doc.pages[0])
+	return docReader, nil
+}
+
+// applyPDFPageSize Fill in the ticket's orientation and media from the document's first page, or warn if the page
+// doesn't match the ticket's paper.
+func applyPDFPageSize(ticketAttrs *jobticket.JobTicket, page pdfPage) {
+	if page.width <= 0 || page.height <= 0 {
+		return
+	}
+	width, height := page.width*pdfPointSize, page.height*pdfPointSize
+
+	if ticketAttrs.OptionalPDLOverrides.Orientation == "" {
+		ticketAttrs.OptionalPDLOverrides.Orientation = jobticket.OrientationPortrait
+		if width > height {
+			ticketAttrs.OptionalPDLOverrides.Orientation = jobticket.OrientationLandscape
+		}
+		pclog.Devf("orientation %s taken from the document", ticketAttrs.OptionalPDLOverrides.Orientation)
+	}
+
+	documentSize := mediaSizeForDimensions(width, height)
+	if ticketAttrs.PaperName == jobticket.PaperNameAuto {
+		ticketAttrs.PaperName = documentSize.Name
+		ticketAttrs.PaperWidthMM = int(math.Round(documentSize.Width / 100))
+		ticketAttrs.PaperHeightMM = int(math.Round(documentSize.Height / 100))
+		msg := fmt.Sprintf("media %s taken from the document", documentSize.Name)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+		return
+	}
+
+	ticketSize, ok := lookupMediaSize(ticketAttrs.PaperName)
+	if !ok {
+		ticketSize = ipp.MediaType{Width: float64(ticketAttrs.PaperWidthMM * 100), Height: float64(ticketAttrs.PaperHeightMM * 100)}
+	}
+	if mediaSizeDistance(ticketSize, documentSize) > mediaSizeTolerance {
+		msg := fmt.Sprintf("ticket paper %s doesn't match the document's %.0fx%.0fmm pages", ticketAttrs.PaperName, width/100, height/100)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+	}
+}
@@ -7,6 +7,12 @@ import (
 	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
 )
 
+// orientation-requested values the ippclient doesn't name, see RFC 8011 section 5.2.10.
+var (
+	orientationReverseLandscape = ipp.Integer{Value: 5}
+	orientationReversePortrait  = ipp.Integer{Value: 6}
+)
+
 func applyPdlOverrides(jobAttrs *ippclient.PrintJobTemplateAttributes, ticket *jobticket.JobTicket) {
 
 	if ticket.OptionalPDLOverrides.Orientation != "" {
@@ -21,6 +27,10 @@ func ippOrientation(orientation jobticket.OrientationType) ippclient.Orientation
 		return ippclient.OrientationPortrait
 	case jobticket.OrientationLandscape:
 		return ippclient.OrientationLandscape
+	case jobticket.OrientationReverseLandscape:
+		return orientationReverseLandscape
+	case jobticket.OrientationReversePortrait:
+		return orientationReversePortrait
 	}
 
 	return ipp.Integer{}
@@ -0,0 +1,110 @@
+package ippprintclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// The PJL languages of the document formats a PJL header is injected into.
+var pjlHeaderLanguages = []string{"PCL", "PCLXL", "POSTSCRIPT"}
+
+// pjlLanguage The PJL language of a document format, "" if PJL headers aren't injected into it.
+func pjlLanguage(format string) string {
+	for _, language := range pjlHeaderLanguages {
+		if sameDocumentFormat(format, pjlLanguageFormats[language]) {
+			return language
+		}
+	}
+	return ""
+}
+
+// injectsPJLHeader Whether the ticket's settings are sent in a PJL header as well as in IPP attributes,
+// for models that ignore IPP attributes for PCL and PostScript jobs.
+func injectsPJLHeader(ticketAttrs *jobticket.JobTicket) bool {
+	return ticketAttrs.OptionalPDLOverrides.PJLHeader && pjlLanguage(ticketAttrs.DocumentFormat) != ""
+}
+
+// pjlSettings The @PJL SET commands for the ticket's duplex, orientation, color and copies.
+func pjlSettings(ticketAttrs *jobticket.JobTicket) []string {
+	var settings []string
+
+	switch ticketAttrs.Sides {
+	case sidesOneSided:
+		settings = append(settings, "DUPLEX=OFF")
+	case "two-sided-long-edge":
+		settings = append(settings, "DUPLEX=ON", "BINDING=LONGEDGE")
+	case "two-sided-short-edge":
+		settings = append(settings, "DUPLEX=ON", "BINDING=SHORTEDGE")
+	}
+
+	// PJL has no reverse orientations.
+	switch ticketAttrs.OptionalPDLOverrides.Orientation {
+	case jobticket.OrientationPortrait, jobticket.OrientationReversePortrait:
+		settings = append(settings, "ORIENTATION=PORTRAIT")
+	case jobticket.OrientationLandscape, jobticket.OrientationReverseLandscape:
+		settings = append(settings, "ORIENTATION=LANDSCAPE")
+	}
+
+	switch ticketAttrs.PrintColorMode {
+	case colorModeMonochrome:
+		settings = append(settings, "RENDERMODE=GRAYSCALE")
+	case "color":
+		settings = append(settings, "RENDERMODE=COLOR")
+	}
+
+	if ticketAttrs.Copies > 1 {
+		settings = append(settings, fmt.Sprintf("COPIES=%d", ticketAttrs.Copies))
+	}
+
+	for i, setting := range settings {
+		settings[i] = "@PJL SET " + setting + "\r\n"
+	}
+	return settings
+}
+
+// pjlJobName The ticket's job name made safe for a PJL string, without quotes or control characters.
+func pjlJobName(ticketAttrs *jobticket.JobTicket) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, ticketAttrs.JobName)
+}
+
+// injectPJLHeader Wrap the document in a PJL job carrying the ticket's settings. A document with its own PJL header
+// gets the settings added just before its ENTER LANGUAGE command, overriding its own. The document is streamed,
+// only its start is buffered.
+func injectPJLHeader(ticketAttrs *jobticket.JobTicket, document *bufio.Reader) io.Reader {
+	settings := strings.Join(pjlSettings(ticketAttrs), "")
+
+	head, _ := document.Peek(sniffLength)
+	if bytes.HasPrefix(head, pjlUEL) {
+		loc := pjlEnterLanguageRegex.FindIndex(head)
+		if loc == nil {
+			pclog.Supportf("document has a PJL header without ENTER LANGUAGE, not injecting PJL settings")
+			return document
+		}
+		existing := make([]byte, loc[0])
+		copy(existing, head)
+		_, _ = document.Discard(loc[0])
+		pclog.Devf("adding PJL settings to the document's PJL header: %q", settings)
+		return io.MultiReader(bytes.NewReader(existing), strings.NewReader(settings), document)
+	}
+
+	job, eoj := "@PJL JOB\r\n", "@PJL EOJ\r\n"
+	if name := pjlJobName(ticketAttrs); name != "" {
+		job, eoj = fmt.Sprintf("@PJL JOB NAME=\"%s\"\r\n", name), fmt.Sprintf("@PJL EOJ NAME=\"%s\"\r\n", name)
+	}
+	header := string(pjlUEL) + job + settings + fmt.Sprintf("@PJL ENTER LANGUAGE=%s\r\n", pjlLanguage(ticketAttrs.DocumentFormat))
+	trailer := string(pjlUEL) + eoj + string(pjlUEL)
+
+	pclog.Devf("injecting PJL header: %q", header)
+	return io.MultiReader(strings.NewReader(header), document, strings.NewReader(trailer))
+}
@@ -4,15 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"math/rand"
 	"net/http"
-	"os"
 	"time"
 
 	"bitbucket.org/papercutsoftware/gopapercut/pclog"
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/printerattributecache"
 )
 
 type ippPrinter struct {
@@ -21,6 +20,17 @@ type ippPrinter struct {
 	ippClient     *ippclient.IPPClient
 	monitor       *monitor
 	retryAttempts int
+	// Don't monitor the jobs sent, set while sending all but the last of the emulated copies.
+	skipMonitor bool
+	// How documents are compressed, see selectCompression.
+	compression string
+	// The HTTP client of ippClient, copied with a longer timeout for document uploads, see uploadClient.
+	httpClient ippclient.HttpClientInterface
+	// What last worked sending a job to the printer, tried first. nil if nothing was learned.
+	learned *printerattributecache.Behaviour
+	// The operation chain entry and document format that sent the last job, see sendJob.
+	operation string
+	docFormat string
 }
 
 // we currently don't support multi document print operations. So this is always true
@@ -32,37 +42,24 @@ const (
 var retryBackoffSeconds int64 = 5
 
 // IPP/1.1 RFC8011: https://tools.ietf.org/html/rfc8011
-func (p *ippPrinter) CreateSendDocument(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, r io.ReadCloser, docFormat string) (*ippclient.JobAttributes, error) {
-	tmpFile, err := os.CreateTemp(p.TmpDir, "pcippclient-*")
-	if err != nil {
-		return nil, &OperationError{
-			Type: ErrPrintDefaultError,
-			Err:  fmt.Errorf("failed to create temporary file: %v", err),
-		}
-	}
-
-	// temp file cleanup
-	defer func() {
-		err := tmpFile.Close()
-		if err != nil {
-			pclog.Devf("err=%v", err)
-		}
-
-		err = os.Remove(tmpFile.Name())
-		if err != nil {
-			pclog.Devf("failed to remove spoolfile: %v", err)
-		}
-	}()
-
-	var docReader = &streamReader{
-		ReadCloser: io.NopCloser(io.TeeReader(r, tmpFile)),
-		tmpFile:    tmpFile,
-	}
-
+// docReader must be at the start of the document, see spoolDocument.
+// Fails with retriesExhaustedError if Create-Job or Send-Document keep failing with temporary errors.
+func (p *ippPrinter) CreateSendDocument(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (*ippclient.JobAttributes, error) {
+	var err error
 	var job *ippclient.JobAttributes
+	lastErr := &OperationError{Type: ErrPrintJobCreation}
 	for p.retryAttempts = 0; p.retryAttempts < maxPrintLoops; p.retryAttempts++ {
 
 		if p.retryAttempts > 0 {
+			// The previous Send-Document may have read some or all of the document.
+			docReader, err = docReader.Reset()
+			if err != nil {
+				return nil, &OperationError{
+					Type: ErrPrintDefaultError,
+					Err:  fmt.Errorf("failed to read document: %v", err),
+				}
+			}
+
 			jitter := rand.Int63n(retryBackoffSeconds)
 			<-time.After(time.Duration(retryBackoffSeconds+jitter) * time.Second)
 		}
@@ -73,16 +70,19 @@ func (p *ippPrinter) CreateSendDocument(ctx context.Context, jobTemplate *ippcli
 
 			ippErr := &ippJobOpError{}
 			if errors.As(err, ippErr) && ippErr.Temporary() {
+				lastErr = &OperationError{Type: ErrPrintJobCreation, Err: fmt.Errorf("ipp Create-Job failed: %w", err)}
 				continue
 			}
 
 			return nil, &OperationError{
 				Type: ErrPrintJobCreation,
-				Err:  fmt.Errorf("ipp Create-Job failed: %v", err),
+				Err:  fmt.Errorf("ipp Create-Job failed: %w", err),
 			}
 		}
 
-		p.monitor.setJobID(resp.JobId)
+		if !p.skipMonitor {
+			p.monitor.setJobID(resp.JobId)
+		}
 
 		_, err = p.sendDocument(ctx, printerURI, resp.JobUri, resp.JobAttributes, docReader, docFormat)
 		if err != nil {
@@ -90,12 +90,13 @@ func (p *ippPrinter) CreateSendDocument(ctx context.Context, jobTemplate *ippcli
 
 			ippErr := &ippJobOpError{}
 			if errors.As(err, ippErr) && ippErr.Temporary() {
+				lastErr = &OperationError{Type: ErrPrintJobSendDocument, Err: fmt.Errorf("ipp Send-Document failed: %w", err)}
 				continue
 			}
 
 			return nil, &OperationError{
 				Type: ErrPrintJobSendDocument,
-				Err:  fmt.Errorf("ipp Send-Document failed: %v", err),
+				Err:  fmt.Errorf("ipp Send-Document failed: %w", err),
 			}
 		}
 
@@ -109,41 +110,22 @@ func (p *ippPrinter) CreateSendDocument(ctx context.Context, jobTemplate *ippcli
 		break
 	}
 
-	return job, nil
-}
-
-// IPP/1.0 RFC2911: https://tools.ietf.org/html/rfc2566
-func (p *ippPrinter) PrintJob(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, r io.ReadCloser, docFormat string) (*ippclient.JobAttributes, error) {
-	tmpFile, err := os.CreateTemp(p.TmpDir, "pcippclient-*")
-	if err != nil {
+	if job == nil {
 		return nil, &OperationError{
-			Type: ErrPrintDefaultError,
-			Err:  fmt.Errorf("failed to create temporary file: %v", err),
+			Type: lastErr.Type,
+			Err:  &retriesExhaustedError{operation: createJobOperation, attempts: maxPrintLoops, err: lastErr.Err},
 		}
 	}
+	return job, nil
+}
 
-	// temp file cleanup
-	defer func() {
-		err := tmpFile.Close()
-		if err != nil {
-			pclog.Devf("err=%v", err)
-		}
-
-		err = os.Remove(tmpFile.Name())
-		if err != nil {
-			pclog.Devf("failed to remove spoolfile: %v", err)
-		}
-	}()
-
+// IPP/1.0 RFC2911: https://tools.ietf.org/html/rfc2566
+// docReader must be at the start of the document, see spoolDocument.
+func (p *ippPrinter) PrintJob(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (*ippclient.JobAttributes, error) {
+	var err error
 	isRetry := false
 	retryWithDefaultCredentials := false
 
-	var docReader readCloseResetter
-	docReader = &streamReader{
-		ReadCloser: io.NopCloser(io.TeeReader(r, tmpFile)),
-		tmpFile:    tmpFile,
-	}
-
 	printJobRetryAttempts := 0
 	var job *ippclient.JobAttributes
 	for {
@@ -182,7 +164,7 @@ func (p *ippPrinter) PrintJob(ctx context.Context, jobTemplate *ippclient.PrintJ
 		}
 
 		startTime := time.Now()
-		resp, err := p.printJob(ctx, printerURI, jobTemplate, docReader, docFormat)
+		resp, err := p.printJob(ctx, printerURI, jobTemplate, docReader, docFormat, printJobRetryAttempts)
 		duration := time.Since(startTime).String()
 		pclog.Devf("print-job responded in %v", time.Since(startTime))
 
@@ -209,7 +191,7 @@ func (p *ippPrinter) PrintJob(ctx context.Context, jobTemplate *ippclient.PrintJ
 
 				return nil, &OperationError{
 					Type: ErrPrintIPPPrintJob,
-					Err:  fmt.Errorf("ipp Print-Job failed: %v", err),
+					Err:  fmt.Errorf("ipp Print-Job failed: %w", err),
 				}
 			}
 
@@ -238,10 +220,21 @@ func (p *ippPrinter) PrintJob(ctx context.Context, jobTemplate *ippclient.PrintJ
 			msg := fmt.Sprintf("Print-Job operation failed with status %s", resp.StatusMessage())
 			pclog.Supportf(msg)
 			processingLogger.LogOperationAttempt(printJobOperation, printJobRetryAttempts, msg, duration)
+
+			// Retrying won't help when the printer rejects the job itself, or doesn't support Print-Job.
+			statusErr := &ippStatusError{operation: printJobOperation, status: resp.StatusCode, msg: msg}
+			if invalidatesPrinterAttributes(statusErr) || resp.StatusCode == statusErrorOperationNotSupported {
+				return nil, &OperationError{
+					Type: ErrPrintIPPPrintJob,
+					Err:  fmt.Errorf("ipp Print-Job failed: %w", statusErr),
+				}
+			}
 			continue
 		}
 
-		p.monitor.setJobID(resp.JobId)
+		if !p.skipMonitor {
+			p.monitor.setJobID(resp.JobId)
+		}
 
 		job = &ippclient.JobAttributes{
 			JobId:           resp.JobId,
@@ -304,7 +297,7 @@ func (p *ippPrinter) createJob(ctx context.Context, jobTemplate *ippclient.Print
 				}
 
 				processingLogger.LogOperationAttempt(createJobOperation, createJobAttempts, err.Error(), createJobDuration)
-				return nil, fmt.Errorf("failed to create job: %v", err)
+				return nil, fmt.Errorf("failed to create job: %w", err)
 			}
 
 			if reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err); isHttpStatusError {
@@ -331,12 +324,14 @@ func (p *ippPrinter) createJob(ctx context.Context, jobTemplate *ippclient.Print
 			pclog.Supportf(msg)
 			processingLogger.LogOperationAttempt(createJobOperation, createJobAttempts, msg, createJobDuration)
 
-			if ippStatus(resp.StatusCode).Recoverable() {
+			// Retrying won't help when the printer doesn't support the operation.
+			statusErr := &ippStatusError{operation: createJobOperation, status: resp.StatusCode, msg: msg}
+			if ippStatus(resp.StatusCode).Recoverable() && !invalidatesPrinterAttributes(statusErr) {
 				pclog.Devf("received recoverable IPP status %s", resp.StatusMessage())
 				continue
 			}
 
-			return resp, fmt.Errorf(msg)
+			return resp, statusErr
 		}
 
 		// validate the job-id returned by the printer.
@@ -397,10 +392,9 @@ func (p *ippPrinter) sendDocument(ctx context.Context, printerURI, jobURI string
 			return nil, fmt.Errorf(msg)
 		}
 
-		sendDocResp, err = p.ippClient.SendDocument(printerURI, jobURI, &ippclient.Document{
-			Format: docFormat,
-			Reader: file,
-		}, lastDocumentFlag, p.Credentials)
+		document, uploadClient, finishUpload := p.upload(file, docFormat, sendDocumentOperation, sendDocAttempts)
+		sendDocResp, err = uploadClient.SendDocument(printerURI, jobURI, document, lastDocumentFlag, p.Credentials)
+		finishUpload()
 		ippInfo := fromSendDocumentResponse(sendDocResp)
 
 		sendDocumentDuration := time.Since(sendDocumentStartTime).String()
@@ -433,7 +427,7 @@ func (p *ippPrinter) sendDocument(ctx context.Context, printerURI, jobURI string
 
 				msg := fmt.Sprintf("Send-Document failed with ipp response: %+v", ippInfo)
 				processingLogger.LogOperationAttempt(sendDocumentOperation, sendDocAttempts, msg, sendDocumentDuration)
-				return nil, fmt.Errorf("failed to send document: %v", err)
+				return nil, fmt.Errorf("failed to send document: %w", err)
 			}
 
 			if reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err); isHttpStatusError {
@@ -464,12 +458,14 @@ func (p *ippPrinter) sendDocument(ctx context.Context, printerURI, jobURI string
 			pclog.Supportf(msg)
 			processingLogger.LogOperationAttempt(sendDocumentOperation, sendDocAttempts, msg, sendDocumentDuration)
 
-			if ippStatus(sendDocResp.StatusCode).Recoverable() {
+			// Retrying won't help when the printer doesn't support the operation.
+			statusErr := &ippStatusError{operation: sendDocumentOperation, status: sendDocResp.StatusCode, msg: msg}
+			if ippStatus(sendDocResp.StatusCode).Recoverable() && !invalidatesPrinterAttributes(statusErr) {
 				pclog.Devf("received recoverable status %s", sendDocResp.StatusMessage())
 				continue
 			}
 
-			return nil, fmt.Errorf(msg)
+			return nil, statusErr
 		}
 
 		msg := fmt.Sprintf("send-document response status code: %v, ippStatus: %+v", sendDocResp.StatusCode, ippInfo)
@@ -506,15 +502,14 @@ func (p *ippPrinter) cancelJob(printerURI string, jobID int) {
 	pclog.Devf("job %d cancelled", jobID)
 }
 
-func (p *ippPrinter) printJob(ctx context.Context, printerURI string, jobTemplate *ippclient.PrintJobTemplateAttributes, file io.ReadCloser, docFormat string) (*ippclient.PrintJobResponse, error) {
+func (p *ippPrinter) printJob(ctx context.Context, printerURI string, jobTemplate *ippclient.PrintJobTemplateAttributes, file readCloseResetter, docFormat string, attempt int) (*ippclient.PrintJobResponse, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	printJobResp, err := p.ippClient.PrintJob(printerURI, &ippclient.Document{
-		Format: docFormat,
-		Reader: file,
-	}, jobTemplate, p.Credentials)
+	document, uploadClient, finishUpload := p.upload(file, docFormat, printJobOperation, attempt)
+	printJobResp, err := uploadClient.PrintJob(printerURI, document, jobTemplate, p.Credentials)
+	finishUpload()
 
 	ippInfo := fromPrintJobResponse(printJobResp)
 	if err != nil {
@@ -0,0 +1,115 @@
+package printerattributecache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	atomicwrite "github.com/natefinch/atomic"
+)
+
+const behaviourSuffix = ".ipp.behaviour"
+
+// Behaviour What last worked sending a job to a printer, tried first by the next job.
+type Behaviour struct {
+	Operation      string `json:"operation"`       // The operation chain entry that sent the job, e.g. print-job
+	Credentials    string `json:"credentials"`     // Which credentials the printer accepted, e.g. default
+	DocumentFormat string `json:"document-format"` // The document format the printer accepted
+	// What the printer reported itself as when the behaviour was learned. A different printer behind the
+	// same URI, or a firmware update, may behave differently, so the behaviour expires when these change.
+	MakeAndModel    string    `json:"printer-make-and-model"`
+	FirmwareVersion string    `json:"printer-firmware-version"`
+	Updated         time.Time `json:"updated"`
+}
+
+type behaviourElement struct {
+	PrinterUri string    `json:"printer-uri"` // Normalized printer URI.
+	Behaviour  Behaviour `json:"behaviour"`
+}
+
+// PrinterIdentity The make and model and firmware version behaviour learned from a printer is tied to.
+func PrinterIdentity(attributes *ippclient.PrinterAttributes) (makeAndModel, firmwareVersion string) {
+	return strings.TrimSpace(attributes.PrinterMakeModel), strings.TrimSpace(strings.Join(attributes.PrinterFirmwareStringVersion, ","))
+}
+
+// LearnBehaviour Record what worked sending a job to the printer, replacing what was learned before.
+// The printer identity is taken from attributes.
+func (i *PrinterAttributeCache) LearnBehaviour(uri string, behaviour Behaviour, attributes *ippclient.PrinterAttributes) error {
+	if i == nil {
+		return ErrCacheUninitialised
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return fmt.Errorf("ipp-printer-attribute-cache: %v", err)
+	}
+
+	behaviour.MakeAndModel, behaviour.FirmwareVersion = PrinterIdentity(attributes)
+	behaviour.Updated = time.Now()
+	b, err := json.Marshal(&behaviourElement{PrinterUri: normalized, Behaviour: behaviour})
+	if err != nil {
+		return err
+	}
+	return atomicwrite.WriteFile(i.behaviourPath(cacheKey(normalized)), bytes.NewReader(b))
+}
+
+// LearnedBehaviour Get what last worked sending a job to the printer. Returns ErrNotExist if nothing was learned,
+// and ErrCacheExpired, forgetting the behaviour, if the printer's make and model or firmware version changed
+// since, according to attributes.
+func (i *PrinterAttributeCache) LearnedBehaviour(uri string, attributes *ippclient.PrinterAttributes) (*Behaviour, error) {
+	if i == nil {
+		return nil, ErrCacheUninitialised
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("ipp-printer-attribute-cache: %v", err)
+	}
+
+	path := i.behaviourPath(cacheKey(normalized))
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	var element behaviourElement
+	if err := json.Unmarshal(data, &element); err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("ipp-printer-attribute-cache: failed to read learned behaviour: %v", err)
+	}
+
+	makeAndModel, firmwareVersion := PrinterIdentity(attributes)
+	if element.Behaviour.MakeAndModel != makeAndModel || element.Behaviour.FirmwareVersion != firmwareVersion {
+		pclog.Supportf("ipp-printer-attribute-cache: printer %v changed from %q %q to %q %q, forgetting learned behaviour",
+			normalized, element.Behaviour.MakeAndModel, element.Behaviour.FirmwareVersion, makeAndModel, firmwareVersion)
+		_ = os.Remove(path)
+		return nil, ErrCacheExpired
+	}
+	return &element.Behaviour, nil
+}
+
+// ForgetBehaviour Remove what was learned about sending jobs to the printer.
+func (i *PrinterAttributeCache) ForgetBehaviour(uri string) error {
+	if i == nil {
+		return ErrCacheUninitialised
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return fmt.Errorf("ipp-printer-attribute-cache: %v", err)
+	}
+	if err := os.Remove(i.behaviourPath(cacheKey(normalized))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (i *PrinterAttributeCache) behaviourPath(key string) string {
+	return filepath.Join(i.cacheDir, key+behaviourSuffix)
+}
@@ -0,0 +1,169 @@
+package printerattributecache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/filelock"
+	atomicwrite "github.com/natefinch/atomic"
+)
+
+const (
+	indexFile        = "index.json"
+	indexLockFile    = "index.lock"
+	layoutFile       = "layout.version"
+	layoutLockFile   = "layout.lock"
+	attributesSuffix = ".ipp.attributes"
+	// Layout 1 named files after the URI with special characters replaced by underscores.
+	// Layout 2 names files after the hash of the normalized URI.
+	currentLayout = "2"
+	// Upper bound on waiting for another process to update the index or migrate the directory.
+	indexLockTimeout = 5 * time.Second
+)
+
+// cacheIndex Maps cache keys back to the printer URIs, only for people looking at the cache directory.
+// The cache itself never relies on it, the URI is also stored in each cache element.
+type cacheIndex map[string]string
+
+func (i *PrinterAttributeCache) readIndex() (cacheIndex, error) {
+	data, err := os.ReadFile(filepath.Join(i.cacheDir, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return cacheIndex{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index := cacheIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// updateIndex Apply update to the index under the index lock.
+func (i *PrinterAttributeCache) updateIndex(update func(index cacheIndex) bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), indexLockTimeout)
+	defer cancel()
+	lock, err := filelock.Acquire(ctx, filepath.Join(i.cacheDir, indexLockFile), refreshLockPollInterval)
+	if err != nil {
+		return fmt.Errorf("failed to lock the cache index: %v", err)
+	}
+	defer i.releaseLock(lock, indexFile)
+
+	index, err := i.readIndex()
+	if err != nil {
+		// A corrupt index is rebuilt from scratch, it's informational only.
+		pclog.Devf("ipp-printer-attribute-cache: failed to read index, rebuilding: %v", err)
+		index = cacheIndex{}
+	}
+	if !update(index) {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicwrite.WriteFile(filepath.Join(i.cacheDir, indexFile), bytes.NewReader(b))
+}
+
+// addToIndex Record the URI for the key, if it isn't already.
+func (i *PrinterAttributeCache) addToIndex(key, normalizedURI string) {
+	if index, err := i.readIndex(); err == nil && index[key] == normalizedURI {
+		return
+	}
+
+	err := i.updateIndex(func(index cacheIndex) bool {
+		if index[key] == normalizedURI {
+			return false
+		}
+		index[key] = normalizedURI
+		return true
+	})
+	if err != nil {
+		pclog.Devf("ipp-printer-attribute-cache: failed to update index for %v: %v", normalizedURI, err)
+	}
+}
+
+// migrate Move cache elements from older directory layouts to the current one.
+// Runs once per cache directory, whichever process gets there first does the work.
+func (i *PrinterAttributeCache) migrate() error {
+	if i.layoutIsCurrent() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexLockTimeout)
+	defer cancel()
+	lock, err := filelock.Acquire(ctx, filepath.Join(i.cacheDir, layoutLockFile), refreshLockPollInterval)
+	if err != nil {
+		return fmt.Errorf("failed to lock the cache directory for migration: %v", err)
+	}
+	defer i.releaseLock(lock, layoutFile)
+
+	if i.layoutIsCurrent() {
+		return nil
+	}
+
+	entries, err := os.ReadDir(i.cacheDir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, attributesSuffix) || isCacheKey(strings.TrimSuffix(name, attributesSuffix)) {
+			continue
+		}
+		if err := i.migrateFile(filepath.Join(i.cacheDir, name)); err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: failed to migrate %v, dropping it: %v", name, err)
+		}
+		_ = os.Remove(filepath.Join(i.cacheDir, name))
+	}
+
+	return atomicwrite.WriteFile(filepath.Join(i.cacheDir, layoutFile), strings.NewReader(currentLayout))
+}
+
+// migrateFile Rewrite a layout 1 cache file under its layout 2 name.
+// Layout 1 files had no update times, the file modification time stands in for them.
+func (i *PrinterAttributeCache) migrateFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	cacheElem, err := readPrinterAttributesFromFile(path)
+	if err != nil {
+		return err
+	}
+
+	normalized, err := normalizeURI(cacheElem.PrinterUri)
+	if err != nil {
+		return err
+	}
+	cacheElem.PrinterUri = normalized
+	if cacheElem.CapabilitiesUpdated.IsZero() {
+		cacheElem.CapabilitiesUpdated = info.ModTime()
+	}
+	if cacheElem.StateUpdated.IsZero() {
+		cacheElem.StateUpdated = info.ModTime()
+	}
+
+	// Several layout 1 files may map to the same printer, keep the newest.
+	if existing, err := readPrinterAttributesFromFile(i.filePath(cacheKey(normalized))); err == nil &&
+		!existing.CapabilitiesUpdated.Before(cacheElem.CapabilitiesUpdated) {
+		return nil
+	}
+	return i.setElement(cacheElem)
+}
+
+func (i *PrinterAttributeCache) layoutIsCurrent() bool {
+	data, err := os.ReadFile(filepath.Join(i.cacheDir, layoutFile))
+	return err == nil && strings.TrimSpace(string(data)) == currentLayout
+}
@@ -0,0 +1,335 @@
+package printerattributecache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/filelock"
+	atomicwrite "github.com/natefinch/atomic"
+)
+
+const (
+	gcLockFile   = "gc.lock"
+	gcMarkerFile = "gc.last"
+)
+
+// Limits Size limits of the cache directory, enforced by garbage collection.
+// Zero means no limit.
+type Limits struct {
+	MaxEntries int
+	MaxSize    int64 // In bytes, the total size of the cache element files.
+}
+
+// Entry A cache element as seen by the cache maintenance commands.
+type Entry struct {
+	URI                 string                       `json:"printer-uri"`
+	Attributes          *ippclient.PrinterAttributes `json:"ipp-attributes,omitempty"`
+	CapabilitiesUpdated time.Time                    `json:"capabilities-updated"`
+	StateUpdated        time.Time                    `json:"state-updated"`
+	// The capabilities are past their time to live and past MaxStale, the cache won't serve them any more.
+	Expired bool  `json:"expired"`
+	Size    int64 `json:"size"`
+	// What last worked sending a job to the printer, only filled in by Lookup.
+	Behaviour *Behaviour `json:"learned-behaviour,omitempty"`
+
+	key string
+}
+
+// SetLimits Set the size limits of the cache, enforced the next time garbage is collected.
+func (i *PrinterAttributeCache) SetLimits(limits Limits) {
+	if i == nil {
+		return
+	}
+	i.limits = limits
+}
+
+// Entries Get all the entries in the cache, oldest capabilities first.
+// Entries that can't be read are skipped.
+func (i *PrinterAttributeCache) Entries() ([]*Entry, error) {
+	if i == nil {
+		return nil, ErrCacheUninitialised
+	}
+	dirEntries, err := os.ReadDir(i.cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	now := time.Now()
+	var entries []*Entry
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		key := strings.TrimSuffix(name, attributesSuffix)
+		if dirEntry.IsDir() || !strings.HasSuffix(name, attributesSuffix) || !isCacheKey(key) {
+			continue
+		}
+
+		filePath := i.filePath(key)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+		cacheElem, err := readPrinterAttributesFromFile(filePath)
+		if err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: failed to read %v: %v", name, err)
+			continue
+		}
+		entries = append(entries, i.toEntry(cacheElem, key, info.Size(), now))
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].CapabilitiesUpdated.Before(entries[b].CapabilitiesUpdated)
+	})
+	return entries, nil
+}
+
+// Lookup Get the cache entry for the given URI regardless of its age, with what was learned about sending jobs to it.
+func (i *PrinterAttributeCache) Lookup(uri string) (*Entry, error) {
+	cacheElem, err := i.getElement(uri)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(cacheElem.PrinterUri)
+	var size int64
+	if info, err := os.Stat(i.filePath(key)); err == nil {
+		size = info.Size()
+	}
+	entry := i.toEntry(cacheElem, key, size, time.Now())
+	entry.Behaviour, _ = i.LearnedBehaviour(cacheElem.PrinterUri, &cacheElem.IppAttributes)
+	return entry, nil
+}
+
+func (i *PrinterAttributeCache) toEntry(cacheElem *cacheElement, key string, size int64, now time.Time) *Entry {
+	attributes := cacheElem.IppAttributes
+	return &Entry{
+		URI:                 cacheElem.PrinterUri,
+		Attributes:          &attributes,
+		CapabilitiesUpdated: cacheElem.CapabilitiesUpdated,
+		StateUpdated:        cacheElem.StateUpdated,
+		Expired:             !i.capabilitiesUsable(cacheElem, now),
+		Size:                size,
+		key:                 key,
+	}
+}
+
+// Purge Remove the cache entry for the given URI.
+func (i *PrinterAttributeCache) Purge(uri string) error {
+	if i == nil {
+		return ErrCacheUninitialised
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return fmt.Errorf("ipp-printer-attribute-cache: %v", err)
+	}
+
+	key := cacheKey(normalized)
+	if _, err := os.Stat(i.filePath(key)); errors.Is(err, os.ErrNotExist) {
+		i.memory.remove(normalized)
+		_ = os.Remove(i.behaviourPath(key))
+		return ErrNotExist
+	}
+	i.removeEntries([]*Entry{{URI: normalized, key: key}})
+	return nil
+}
+
+// PurgeExpired Remove the entries the cache won't serve any more. Returns the number removed.
+func (i *PrinterAttributeCache) PurgeExpired() (int, error) {
+	entries, err := i.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	var expired []*Entry
+	for _, entry := range entries {
+		if entry.Expired {
+			expired = append(expired, entry)
+		}
+	}
+	i.removeEntries(expired)
+	return len(expired), nil
+}
+
+// PurgeAll Remove every entry, keeping the cache directory itself.
+func (i *PrinterAttributeCache) PurgeAll() (int, error) {
+	entries, err := i.Entries()
+	if err != nil {
+		return 0, err
+	}
+	i.removeEntries(entries)
+	return len(entries), nil
+}
+
+// removeEntries Remove the entry files, their learned behaviour and their index entries, skipping entries
+// being refreshed. Lock files are left in place, see filelock.Lock.Release: another process may have the
+// lock file open, waiting for the lock, and would end up locking a different file than the next process.
+func (i *PrinterAttributeCache) removeEntries(entries []*Entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	removed := make(map[string]bool)
+	for _, entry := range entries {
+		lockPath := i.lockPath(entry.key)
+		lock, ok, err := filelock.TryLock(lockPath)
+		if err != nil || !ok {
+			pclog.Devf("ipp-printer-attribute-cache: %v is being refreshed, not removing it", entry.URI)
+			continue
+		}
+
+		i.memory.remove(entry.URI)
+		if err := os.Remove(i.filePath(entry.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			pclog.Devf("ipp-printer-attribute-cache: failed to remove %v: %v", entry.URI, err)
+		} else {
+			removed[entry.key] = true
+		}
+		_ = os.Remove(i.behaviourPath(entry.key))
+		i.releaseLock(lock, entry.URI)
+	}
+
+	err := i.updateIndex(func(index cacheIndex) bool {
+		changed := false
+		for key := range removed {
+			if _, ok := index[key]; ok {
+				delete(index, key)
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		pclog.Devf("ipp-printer-attribute-cache: failed to update index: %v", err)
+	}
+}
+
+// Export Write all the cache entries to w, for seeding the cache on another host with Import.
+func (i *PrinterAttributeCache) Export(w io.Writer) (int, error) {
+	entries, err := i.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	elements := make([]cacheElement, 0, len(entries))
+	for _, entry := range entries {
+		elements = append(elements, cacheElement{
+			PrinterUri:          entry.URI,
+			IppAttributes:       *entry.Attributes,
+			CapabilitiesUpdated: entry.CapabilitiesUpdated,
+			StateUpdated:        entry.StateUpdated,
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(elements); err != nil {
+		return 0, err
+	}
+	return len(elements), nil
+}
+
+// Import Read cache entries written by Export into the cache. Returns the number imported.
+// The printer state of another host says nothing about this one, so imported entries
+// keep their capabilities but always refresh their state on first use.
+// Entries already cached with newer capabilities are kept as they are.
+func (i *PrinterAttributeCache) Import(r io.Reader) (int, error) {
+	if i == nil {
+		return 0, ErrCacheUninitialised
+	}
+
+	var elements []cacheElement
+	if err := json.NewDecoder(r).Decode(&elements); err != nil {
+		return 0, fmt.Errorf("failed to read cache entries: %v", err)
+	}
+
+	imported := 0
+	for _, cacheElem := range elements {
+		normalized, err := normalizeURI(cacheElem.PrinterUri)
+		if err != nil {
+			pclog.Errorf("ipp-printer-attribute-cache: skipping entry: %v", err)
+			continue
+		}
+		cacheElem.PrinterUri = normalized
+		cacheElem.StateUpdated = time.Time{}
+
+		if existing, err := i.getElement(normalized); err == nil &&
+			!existing.CapabilitiesUpdated.Before(cacheElem.CapabilitiesUpdated) {
+			continue
+		}
+		if err := i.setElement(&cacheElem); err != nil {
+			return imported, fmt.Errorf("failed to import %v: %v", normalized, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// CollectGarbageInBackground Collect garbage without blocking the caller, unless garbage
+// was collected by any process within the interval.
+func (i *PrinterAttributeCache) CollectGarbageInBackground(interval time.Duration) {
+	if i == nil {
+		return
+	}
+	if info, err := os.Stat(filepath.Join(i.cacheDir, gcMarkerFile)); err == nil && time.Since(info.ModTime()) < interval {
+		return
+	}
+
+	lock, ok, err := filelock.TryLock(filepath.Join(i.cacheDir, gcLockFile))
+	if err != nil || !ok {
+		return
+	}
+
+	// Mark the run up front, so other processes starting now don't all collect too.
+	_ = atomicwrite.WriteFile(filepath.Join(i.cacheDir, gcMarkerFile), strings.NewReader(time.Now().Format(time.RFC3339)))
+
+	i.background.Add(1)
+	go func() {
+		defer i.background.Done()
+		defer i.releaseLock(lock, gcLockFile)
+
+		removed, err := i.CollectGarbage()
+		if err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: garbage collection failed: %v", err)
+			return
+		}
+		pclog.Devf("ipp-printer-attribute-cache: garbage collection removed %d entries", removed)
+	}()
+}
+
+// CollectGarbage Remove the expired entries, then the entries with the oldest capabilities
+// until the cache is within its limits. Returns the number of entries removed.
+func (i *PrinterAttributeCache) CollectGarbage() (int, error) {
+	entries, err := i.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	var remove, keep []*Entry
+	var size int64
+	for _, entry := range entries {
+		if entry.Expired {
+			remove = append(remove, entry)
+			continue
+		}
+		keep = append(keep, entry)
+		size += entry.Size
+	}
+
+	// Entries are sorted oldest first.
+	for len(keep) > 0 &&
+		((i.limits.MaxEntries > 0 && len(keep) > i.limits.MaxEntries) ||
+			(i.limits.MaxSize > 0 && size > i.limits.MaxSize)) {
+		remove = append(remove, keep[0])
+		size -= keep[0].Size
+		keep = keep[1:]
+	}
+
+	i.removeEntries(remove)
+	return len(remove), nil
+}
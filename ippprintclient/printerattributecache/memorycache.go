@@ -0,0 +1,80 @@
+package printerattributecache
+
+import (
+	"container/list"
+	"sync"
+)
+
+const defaultMemoryCacheEntries = 64
+
+// memoryCache In-process LRU tier in front of the cache files.
+// Elements carry their own update times, so the same expiry rules apply to both tiers.
+type memoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type memoryEntry struct {
+	uri     string
+	element cacheElement
+}
+
+func newMemoryCache(capacity int) *memoryCache {
+	return &memoryCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get Returns a copy of the cached element, callers are free to modify it.
+func (m *memoryCache) get(uri string) (cacheElement, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.items[uri]
+	if !ok {
+		return cacheElement{}, false
+	}
+	m.ll.MoveToFront(e)
+	return e.Value.(*memoryEntry).element, true
+}
+
+func (m *memoryCache) put(uri string, element cacheElement) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.items[uri]; ok {
+		entry := e.Value.(*memoryEntry)
+		entry.element = element
+		m.ll.MoveToFront(e)
+		return
+	}
+
+	m.items[uri] = m.ll.PushFront(&memoryEntry{uri: uri, element: element})
+	for m.ll.Len() > m.capacity {
+		oldest := m.ll.Back()
+		m.ll.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryEntry).uri)
+	}
+}
+
+func (m *memoryCache) remove(uri string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.items[uri]; ok {
+		m.ll.Remove(e)
+		delete(m.items, uri)
+	}
+}
+
+func (m *memoryCache) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ll.Init()
+	m.items = make(map[string]*list.Element)
+}
@@ -2,47 +2,95 @@ package printerattributecache
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
 	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/filelock"
 	utilconfig "bitbucket.org/papercutsoftware/pmitc-coordinator/util/config"
 	atomicwrite "github.com/natefinch/atomic"
 )
 
-const fileTemplate = "%s.ipp.attributes"
+const fileTemplate = "%s" + attributesSuffix
+const lockFileTemplate = "%s.ipp.lock"
 const cacheDir = "ipp-printer-attribute-cache"
 
+// How often a process waiting for another process's refresh checks the lock again.
+const refreshLockPollInterval = 100 * time.Millisecond
+
+// How long a background refresh may take. It outlives the request that started it, so it has its own deadline.
+const backgroundRefreshTimeout = 2 * time.Minute
+
 type cacheElement struct {
-	PrinterUri    string                      `json:"printer-uri"`
+	PrinterUri    string                      `json:"printer-uri"` // Normalized printer URI.
 	IppAttributes ippclient.PrinterAttributes `json:"ipp-attributes"`
+	// When the static capabilities and the volatile printer state were last fetched.
+	// Elements written before these were added have zero times and are treated as expired.
+	CapabilitiesUpdated time.Time `json:"capabilities-updated"`
+	StateUpdated        time.Time `json:"state-updated"`
 }
 
 var ErrCacheExpired = errors.New("cache element expired")
 var ErrNotExist = errors.New("file doesn't exist")
 var ErrCacheUninitialised = errors.New("uninitialised cache")
 
+// Expiry Cache expiry durations.
+// Capabilities such as document-format-supported or finishings-supported rarely change,
+// while printer-is-accepting-jobs and printer-state-reasons change constantly, so each
+// has its own time to live.
+type Expiry struct {
+	Capabilities time.Duration // Time to live of the static printer capabilities.
+	State        time.Duration // Time to live of the volatile printer state.
+	// How long past their time to live capabilities may still be served while they are
+	// refreshed in the background. Zero disables serving stale capabilities.
+	MaxStale time.Duration
+}
+
 type PrinterAttributeCache struct {
-	cacheDir    string
-	cacheExpiry time.Duration
+	cacheDir string
+	expiry   Expiry
+	memory   *memoryCache
+	limits   Limits
+	// Background refreshes and garbage collection in flight.
+	background sync.WaitGroup
 }
 
+// FetchFunc Fetches fresh printer attributes from the printer, used to refresh the cache.
+// When stateOnly is set only the volatile printer state is needed, the cached capabilities
+// are still fresh, so the caller can request a much smaller set of attributes.
+// Background refreshes call it with their own context, not the one passed to RefreshPrinterAttributes.
+type FetchFunc func(ctx context.Context, stateOnly bool) (*ippclient.PrinterAttributes, error)
+
 // NewCache Get a new IPP printer cache.
-// expiry - Cache expiry duration in Seconds.
+// expiry - Cache expiry duration in Seconds, used for both the capabilities and the printer state.
 // Note : This is backed by a directory /path/ipp-printerinfo-cache,
 // Multiple instances of the PrinterAttributeCache could access the same dir.
 func NewCache(expirySec uint, path string) (*PrinterAttributeCache, error) {
-	pc := &PrinterAttributeCache{}
-	pc.cacheExpiry = time.Duration(expirySec) * time.Second
 	if expirySec == 0 {
 		return nil, fmt.Errorf("invalid cache expiry duration %v", expirySec)
 	}
+	expiry := time.Duration(expirySec) * time.Second
+	return NewCacheWithExpiry(Expiry{Capabilities: expiry, State: expiry}, path)
+}
+
+// NewCacheWithExpiry Get a new IPP printer cache with separate expiry durations for
+// the printer capabilities and the printer state.
+func NewCacheWithExpiry(expiry Expiry, path string) (*PrinterAttributeCache, error) {
+	if expiry.Capabilities <= 0 || expiry.State <= 0 || expiry.MaxStale < 0 {
+		return nil, fmt.Errorf("invalid cache expiry durations %+v", expiry)
+	}
+	pc := &PrinterAttributeCache{
+		expiry: expiry,
+		memory: newMemoryCache(defaultMemoryCacheEntries),
+	}
 	err := pc.Initialise(path)
 	if err != nil {
 		return nil, err
@@ -57,9 +105,22 @@ func (i *PrinterAttributeCache) Cleanup() {
 	if i == nil {
 		return
 	}
+	i.Wait()
+	if i.memory != nil {
+		i.memory.clear()
+	}
 	_ = os.RemoveAll(i.cacheDir)
 }
 
+// Wait Wait for background refreshes and garbage collection to finish. Call it before the process exits,
+// so that they aren't cut short leaving partially refreshed entries locked until the next run.
+func (i *PrinterAttributeCache) Wait() {
+	if i == nil {
+		return
+	}
+	i.background.Wait()
+}
+
 func (i *PrinterAttributeCache) Initialise(path string) error {
 
 	if i == nil {
@@ -71,38 +132,84 @@ func (i *PrinterAttributeCache) Initialise(path string) error {
 		return err
 	}
 	i.cacheDir = fullPath
+	if i.memory == nil {
+		i.memory = newMemoryCache(defaultMemoryCacheEntries)
+	}
+
+	// A failed migration only costs the printers a refresh, don't fail the cache for it.
+	if err := i.migrate(); err != nil {
+		pclog.Errorf("ipp-printer-attribute-cache: failed to migrate cache directory: %v", err)
+	}
 
 	return nil
 }
 
 // SetPrinterAttributes Set the printer attributes to cache for the given URI.
+// Both the capabilities and the printer state are considered fresh from now.
 func (i *PrinterAttributeCache) SetPrinterAttributes(uri string, attributes *ippclient.PrinterAttributes) error {
 
 	if i == nil {
 		return ErrCacheUninitialised
 	}
+	if uri == "" || attributes == nil {
+		return fmt.Errorf("ipp-printer-attribute-cache: invalid parameters")
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return fmt.Errorf("ipp-printer-attribute-cache: %v", err)
+	}
+	now := time.Now()
+	return i.setElement(&cacheElement{
+		PrinterUri:          normalized,
+		IppAttributes:       *attributes,
+		CapabilitiesUpdated: now,
+		StateUpdated:        now,
+	})
+}
+
+// setElement Write the cache element, its PrinterUri must already be normalized.
+func (i *PrinterAttributeCache) setElement(printer *cacheElement) error {
+
 	if i.cacheDir == "" {
 		return fmt.Errorf("ipp-printer-attribute-cache: un-initialised cache")
 	}
-	if uri == "" || attributes == nil {
+	if printer.PrinterUri == "" {
 		return fmt.Errorf("ipp-printer-attribute-cache: invalid parameters")
 	}
-	filePath := filepath.Join(i.cacheDir, fmt.Sprintf(fileTemplate, convertURItoFileName(uri)))
+	key := cacheKey(printer.PrinterUri)
+	filePath := i.filePath(key)
 	if filePath == "" {
 		return fmt.Errorf("failed to create file path")
 	}
 
-	printer := &cacheElement{
-		PrinterUri:    uri,
-		IppAttributes: *attributes,
+	if err := writePrinterAttributesToFile(printer, filePath); err != nil {
+		i.memory.remove(printer.PrinterUri)
+		return err
 	}
-	return writePrinterAttributesToFile(printer, filePath)
+	i.memory.put(printer.PrinterUri, *printer)
+	i.addToIndex(key, printer.PrinterUri)
+	return nil
 }
 
 // GetPrinterAttributes Get the printer attributes from cache for the given URI.
 // Return nil if failure, cache expired or not found.
+// Both the capabilities and the printer state must be within their time to live.
 func (i *PrinterAttributeCache) GetPrinterAttributes(uri string) (*ippclient.PrinterAttributes, error) {
 
+	cacheElem, err := i.getElement(uri)
+	if err != nil {
+		return nil, err
+	}
+	if !i.capabilitiesFresh(cacheElem, time.Now()) || !i.stateFresh(cacheElem, time.Now()) {
+		return nil, ErrCacheExpired
+	}
+
+	return &cacheElem.IppAttributes, nil
+}
+
+// getElement Get the cache element for the given URI regardless of its age.
+func (i *PrinterAttributeCache) getElement(uri string) (*cacheElement, error) {
+
 	if i == nil {
 		return nil, ErrCacheUninitialised
 	}
@@ -112,72 +219,214 @@ func (i *PrinterAttributeCache) GetPrinterAttributes(uri string) (*ippclient.Pri
 	if uri == "" {
 		return nil, fmt.Errorf("ipp-printer-attribute-cache: invalid uri")
 	}
-
-	filePath := filepath.Join(i.cacheDir, fmt.Sprintf(fileTemplate, convertURItoFileName(uri)))
-	if filePath == "" {
-		return nil, fmt.Errorf("failed to create file path")
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("ipp-printer-attribute-cache: %v", err)
 	}
 
-	expired, err := i.isExpired(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("getPrinterAttributes failed %v, %v", filePath, err)
+	// The in-process tier saves re-reading and decoding the file for repeated lookups.
+	if cacheElem, ok := i.memory.get(normalized); ok {
+		return &cacheElem, nil
 	}
-	if expired {
-		return nil, ErrCacheExpired
+
+	filePath := i.filePath(cacheKey(normalized))
+	if filePath == "" {
+		return nil, fmt.Errorf("failed to create file path")
 	}
 
 	cacheElem, err := readPrinterAttributesFromFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotExist
+	}
 	if err != nil {
 		return nil, fmt.Errorf("getPrinterAttributes: failed to read file %v, %v",
 			filePath, err)
 	}
 
-	if cacheElem.PrinterUri != uri {
+	// Only possible with a hash collision, or a hand edited file.
+	if cacheElem.PrinterUri != normalized {
 		return nil, fmt.Errorf("getPrinterAttributes: cache element URI mispatch in=%v, element uri=%v",
-			uri, cacheElem.PrinterUri)
+			normalized, cacheElem.PrinterUri)
 	}
 
-	return &cacheElem.IppAttributes, nil
+	i.memory.put(normalized, *cacheElem)
+	return cacheElem, nil
 }
 
-// returns whether the cache element is expired.
-// Return values:
+// RefreshPrinterAttributes Get the printer attributes for the given URI, from cache if possible,
+// otherwise by calling fetch and caching the result.
+//   - Fresh capabilities and fresh state are served from the cache.
+//   - Fresh capabilities with expired state only fetch the printer state.
+//   - Capabilities past their time to live but within MaxStale are served as they are, and
+//     refreshed in the background.
+//   - Anything else fetches all the attributes.
 //
-//		Non-existing file, true + ErrNotExist.
-//	 Failed to read file: true + error.
-//	 File is expired: true + nil.
-//	 File is not expired: false + nil.
-func (i *PrinterAttributeCache) isExpired(path string) (bool, error) {
+// Refreshes are coordinated across processes with an advisory lock per URI, only one process
+// calls fetch for a printer while the others wait and then read its result from the cache.
+// Returns whether the capabilities came from the cache. Errors from fetch are returned as is, and
+// the context error if ctx is done while waiting for another process to finish refreshing.
+func (i *PrinterAttributeCache) RefreshPrinterAttributes(ctx context.Context, uri string, fetch FetchFunc) (*ippclient.PrinterAttributes, bool, error) {
 
 	if i == nil {
-		// This is a programming error. expired or not doesn't matter.
-		return false, ErrCacheUninitialised
+		return nil, false, ErrCacheUninitialised
+	}
+	normalized, err := normalizeURI(uri)
+	if err != nil {
+		return nil, false, fmt.Errorf("ipp-printer-attribute-cache: %v", err)
 	}
-	info, err := os.Stat(path)
+	uri = normalized
 
-	// Non-existing file, consider as expired, this makes
-	//	if expired { create/overwrite cache } block would include non-existing case as well.
-	if errors.Is(err, os.ErrNotExist) {
-		return true, ErrNotExist
+	if attributes, ok := i.lookup(uri, fetch); ok {
+		return attributes, true, nil
+	}
+
+	lock, err := filelock.Acquire(ctx, i.lockPath(cacheKey(uri)), refreshLockPollInterval)
+	if err != nil && ctx.Err() != nil {
+		// Gave up waiting for another process to finish refreshing.
+		return nil, false, ctx.Err()
+	}
+	if err != nil {
+		// Locking is an optimisation only, still refresh without it.
+		pclog.Devf("ipp-printer-attribute-cache: failed to lock %v, refreshing without lock: %v", uri, err)
+	} else {
+		defer func() {
+			if lock != nil {
+				i.releaseLock(lock, uri)
+			}
+		}()
+
+		// Another process may have refreshed the printer while we were waiting for the lock. Its
+		// attributes are in the file, the memory copy is the one found expired before waiting.
+		i.memory.remove(uri)
+		if attributes, ok := i.lookup(uri, fetch); ok {
+			return attributes, true, nil
+		}
 	}
-	// Failed to read the file, consider it as expired.
+
+	cacheElem, err := i.getElement(uri)
+	if err == nil && i.capabilitiesUsable(cacheElem, time.Now()) {
+		state, err := fetch(ctx, true)
+		if err != nil {
+			return nil, false, err
+		}
+		mergeState(&cacheElem.IppAttributes, state)
+		cacheElem.StateUpdated = time.Now()
+		if err := i.setElement(cacheElem); err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: failed to save state for %v: %v", uri, err)
+		}
+		if !i.capabilitiesFresh(cacheElem, time.Now()) {
+			if lock != nil {
+				// The background refresh takes over the lock we hold.
+				i.refreshWithLock(uri, fetch, lock)
+				lock = nil
+			} else {
+				i.refreshInBackground(uri, fetch)
+			}
+		}
+		return &cacheElem.IppAttributes, true, nil
+	}
+
+	attributes, err := fetch(ctx, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := i.SetPrinterAttributes(uri, attributes); err != nil {
+		// Failing to cache shouldn't fail the caller.
+		pclog.Devf("ipp-printer-attribute-cache: failed to save attributes for %v: %v", uri, err)
+	}
+	return attributes, false, nil
+}
+
+// lookup Serve the attributes from the cache if the state is fresh and the capabilities are usable.
+// Stale capabilities are refreshed in the background.
+func (i *PrinterAttributeCache) lookup(uri string, fetch FetchFunc) (*ippclient.PrinterAttributes, bool) {
+	cacheElem, err := i.getElement(uri)
 	if err != nil {
-		err = fmt.Errorf("ipp-printer-attribute-cache: failed to read file %v, %v", path, err)
-		return true, err
+		return nil, false
 	}
 
-	modtime := info.ModTime() // Last modified time
-	modtime = modtime.Add(i.cacheExpiry)
 	now := time.Now()
+	if !i.stateFresh(cacheElem, now) || !i.capabilitiesUsable(cacheElem, now) {
+		return nil, false
+	}
+	if !i.capabilitiesFresh(cacheElem, now) {
+		pclog.Devf("ipp-printer-attribute-cache: serving stale capabilities for %v", uri)
+		i.refreshInBackground(uri, fetch)
+	}
+	return &cacheElem.IppAttributes, true
+}
 
-	// is 'now' after the is file's (last access time + cache expiry duration) ?
-	if now.After(modtime) {
-		return true, nil
-	} else {
-		return false, nil
+// refreshInBackground Refresh all the attributes for the given URI without blocking the caller.
+// If another process is already refreshing the printer, there is nothing to do.
+func (i *PrinterAttributeCache) refreshInBackground(uri string, fetch FetchFunc) {
+	lock, ok, err := filelock.TryLock(i.lockPath(cacheKey(uri)))
+	if err != nil || !ok {
+		return
+	}
+	i.refreshWithLock(uri, fetch, lock)
+}
+
+// refreshWithLock Refresh all the attributes for the given URI in the background, releasing lock when done.
+func (i *PrinterAttributeCache) refreshWithLock(uri string, fetch FetchFunc, lock *filelock.Lock) {
+	i.background.Add(1)
+	go func() {
+		defer i.background.Done()
+		defer i.releaseLock(lock, uri)
+
+		ctx, cancel := context.WithTimeout(context.Background(), backgroundRefreshTimeout)
+		defer cancel()
+		attributes, err := fetch(ctx, false)
+		if err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: background refresh failed for %v: %v", uri, err)
+			return
+		}
+		if err := i.SetPrinterAttributes(uri, attributes); err != nil {
+			pclog.Devf("ipp-printer-attribute-cache: failed to save attributes for %v: %v", uri, err)
+		}
+	}()
+}
+
+func (i *PrinterAttributeCache) releaseLock(lock *filelock.Lock, name string) {
+	if err := lock.Release(); err != nil {
+		pclog.Devf("ipp-printer-attribute-cache: failed to unlock %v: %v", name, err)
 	}
 }
 
+func (i *PrinterAttributeCache) capabilitiesFresh(cacheElem *cacheElement, now time.Time) bool {
+	return now.Before(cacheElem.CapabilitiesUpdated.Add(i.expiry.Capabilities))
+}
+
+func (i *PrinterAttributeCache) capabilitiesUsable(cacheElem *cacheElement, now time.Time) bool {
+	return now.Before(cacheElem.CapabilitiesUpdated.Add(i.expiry.Capabilities + i.expiry.MaxStale))
+}
+
+func (i *PrinterAttributeCache) stateFresh(cacheElem *cacheElement, now time.Time) bool {
+	return now.Before(cacheElem.StateUpdated.Add(i.expiry.State))
+}
+
+func (i *PrinterAttributeCache) filePath(key string) string {
+	return filepath.Join(i.cacheDir, fmt.Sprintf(fileTemplate, key))
+}
+
+func (i *PrinterAttributeCache) lockPath(key string) string {
+	return filepath.Join(i.cacheDir, fmt.Sprintf(lockFileTemplate, key))
+}
+
+// mergeState Copy the volatile printer state from state into attributes, keeping the capabilities.
+func mergeState(attributes *ippclient.PrinterAttributes, state *ippclient.PrinterAttributes) {
+	if state == nil {
+		return
+	}
+	attributes.PrinterIsAcceptingJobs = state.PrinterIsAcceptingJobs
+	attributes.PrinterState = state.PrinterState
+	attributes.PrinterStateReasons = state.PrinterStateReasons
+	attributes.QueuedJobCount = state.QueuedJobCount
+	attributes.PrinterUptime = state.PrinterUptime
+	attributes.MediaColReady = state.MediaColReady
+	attributes.MediaReady = state.MediaReady
+}
+
 func readPrinterAttributesFromFile(path string) (*cacheElement, error) {
 
 	data, err := ioutil.ReadFile(path)
@@ -210,13 +459,3 @@ func writePrinterAttributesToFile(attrbs *cacheElement, path string) error {
 	err = atomicwrite.WriteFile(path, bytes.NewReader(b))
 	return err
 }
-
-// convertURItoFileName Generate a file name from URI
-func convertURItoFileName(uri string) string {
-	// Replace characters which are not allowed in a filename with UNDERSCOREs
-	uniqueName := strings.ReplaceAll(uri, "://", "_")
-	uniqueName = strings.ReplaceAll(uniqueName, ":", "_")
-	uniqueName = strings.ReplaceAll(uniqueName, ".", "_")
-	uniqueName = strings.ReplaceAll(uniqueName, "/", "_")
-	return uniqueName
-}
@@ -0,0 +1,83 @@
+package printerattributecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Default ports for the printer URI schemes, a URI without a port is the same printer
+// as one with the default port. IPP over TLS uses the IPP port, see RFC 7472.
+var defaultPorts = map[string]string{
+	"ipp":   "631",
+	"ipps":  "631",
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeURI Get the canonical form of a printer URI, so that different spellings
+// of the same printer share a cache element.
+//   - scheme and host are lower cased, the IPv6 zone is kept as is since interface names are case sensitive.
+//   - the default port for the scheme is made explicit.
+//   - the path is cleaned, empty paths become "/" and trailing slashes are removed.
+//   - user info and fragments are dropped, they don't identify the printer.
+func normalizeURI(uri string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return "", fmt.Errorf("invalid printer uri %q: %v", uri, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("invalid printer uri %q: missing scheme or host", uri)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+
+	host := u.Hostname()
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i:]
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+
+	hostPort := host
+	if strings.Contains(host, ":") {
+		// IPv6 literal, net.JoinHostPort adds the brackets. In a URI the zone separator is escaped.
+		hostPort = host + strings.ReplaceAll(zone, "%", "%25")
+	}
+	if port != "" {
+		hostPort = net.JoinHostPort(hostPort, port)
+	} else if strings.Contains(host, ":") {
+		hostPort = "[" + hostPort + "]"
+	}
+
+	normalized := scheme + "://" + hostPort + path.Clean("/"+u.EscapedPath())
+	if u.RawQuery != "" {
+		normalized += "?" + u.RawQuery
+	}
+	return normalized, nil
+}
+
+// cacheKey Get the file name key for a normalized printer URI.
+// Hashing avoids the collisions of mapping URI characters onto file name characters,
+// the index maps keys back to URIs for people looking at the cache directory.
+func cacheKey(normalizedURI string) string {
+	sum := sha256.Sum256([]byte(normalizedURI))
+	return hex.EncodeToString(sum[:])
+}
+
+func isCacheKey(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,438 @@
+package ippprintclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// documentServerError The document couldn't be served for the printer to fetch with Send-URI or Print-URI.
+type documentServerError struct {
+	err error
+}
+
+func (e *documentServerError) Error() string {
+	return fmt.Sprintf("failed to serve the document: %v", e.err)
+}
+
+func (e *documentServerError) Unwrap() error {
+	return e.err
+}
+
+// documentServer Serves a document over HTTP for the printer to fetch, at a URL with a random path so that only
+// the printer it is given to can fetch it.
+type documentServer struct {
+	url          string
+	path         string
+	format       string
+	server       *http.Server
+	fetchTimeout time.Duration // How long the printer has to fetch the document
+
+	mu          sync.Mutex
+	doc         readCloseResetter
+	fetched     chan struct{}
+	fetchedOnce sync.Once
+}
+
+// serveDocument Start serving the document on -ippDocumentServerAddress, or on a random port of the local address
+// the printer is reached from. The printer has fetchTimeout to fetch it, see wait.
+func serveDocument(printerURI string, doc readCloseResetter, format string, fetchTimeout time.Duration) (*documentServer, error) {
+	address := *ippDocumentServerAddress
+	if address == "" {
+		host, err := localAddressFacing(printerURI)
+		if err != nil {
+			return nil, &documentServerError{err: err}
+		}
+		address = net.JoinHostPort(host, "0")
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, &documentServerError{err: err}
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		_ = listener.Close()
+		return nil, &documentServerError{err: err}
+	}
+
+	s := &documentServer{
+		path:         "/" + hex.EncodeToString(token),
+		format:       format,
+		fetchTimeout: fetchTimeout,
+		doc:          doc,
+		fetched:      make(chan struct{}),
+	}
+	// url.URL escapes the zone of a link-local IPv6 address, e.g. [fe80::1%25eth0].
+	s.url = (&url.URL{Scheme: "http", Host: listener.Addr().String(), Path: s.path}).String()
+	s.server = &http.Server{Handler: s}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			pclog.Devf("document server stopped: %v", err)
+		}
+	}()
+
+	pclog.Devf("serving document at %v", s.url)
+	return s, nil
+}
+
+// localAddressFacing The local IP address connections to the printer are made from.
+func localAddressFacing(printerURI string) (string, error) {
+	u, err := url.Parse(printerURI)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "631"
+	}
+
+	// Connecting a UDP socket sends nothing, it only picks the route.
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = conn.Close() }()
+
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	return host, err
+}
+
+func (s *documentServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The printer may fetch the document more than once, each fetch reads it from the start.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.doc.Reset()
+	if err != nil {
+		pclog.Errorf("failed to serve document: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.doc = doc
+
+	w.Header().Set("Content-Type", s.format)
+	if size := doc.Size(); size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	startTime := time.Now()
+	n, err := io.Copy(w, doc)
+	if err != nil {
+		msg := fmt.Sprintf("printer %v failed to fetch the document after %d bytes: %v", r.RemoteAddr, n, err)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, time.Since(startTime).String())
+		return
+	}
+
+	msg := fmt.Sprintf("printer %v fetched the document: %d bytes", r.RemoteAddr, n)
+	pclog.Supportf(msg)
+	processingLogger.LogOperationAttempt(printJobOperation, 1, msg, time.Since(startTime).String())
+	s.fetchedOnce.Do(func() { close(s.fetched) })
+}
+
+// wait Wait until the printer has fetched the whole document, the document has to be served until then.
+// Fails with documentServerError if the printer hasn't fetched it within the fetch timeout, e.g. because it can't
+// connect back, so that the job falls back to the next operation of the chain.
+func (s *documentServer) wait(ctx context.Context) error {
+	timer := time.NewTimer(s.fetchTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.fetched:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return &documentServerError{err: fmt.Errorf("printer didn't fetch the document within %v", s.fetchTimeout)}
+	}
+}
+
+// documentFetchTimeout How long the printer has to fetch a document of the given size: -ippDocumentFetchTimeoutSec,
+// or by default as long as uploading it may take, at least the request timeout.
+func (p *ippPrinter) documentFetchTimeout(size int64) time.Duration {
+	if *ippDocumentFetchTimeoutSec > 0 {
+		return time.Duration(*ippDocumentFetchTimeoutSec) * time.Second
+	}
+	requestTimeout := defaultHttpRequestTimeoutSec * time.Second
+	if httpClient, ok := p.httpClient.(*http.Client); ok && httpClient.Timeout > 0 {
+		requestTimeout = httpClient.Timeout
+	}
+	if timeout := uploadTimeout(size, requestTimeout, int64(*uploadMinThroughputKBps)*1024); timeout > requestTimeout {
+		return timeout
+	}
+	return requestTimeout
+}
+
+// close Stop serving the document, waiting for a fetch in progress to give up so that the document can be
+// read again.
+func (s *documentServer) close() {
+	if err := s.server.Close(); err != nil {
+		pclog.Devf("failed to stop document server: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+}
+
+// CreateSendURI Create-Job, then Send-URI with the URL of the document server. Returns once the printer
+// has fetched the document.
+// IPP/1.1 RFC8011: https://tools.ietf.org/html/rfc8011
+func (p *ippPrinter) CreateSendURI(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (*ippclient.JobAttributes, error) {
+	server, err := serveDocument(printerURI, docReader, docFormat, p.documentFetchTimeout(docReader.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer server.close()
+
+	resp, err := p.createJob(ctx, jobTemplate, printerURI)
+	if err != nil {
+		return nil, &OperationError{
+			Type: ErrPrintJobCreation,
+			Err:  fmt.Errorf("ipp Create-Job failed: %w", err),
+		}
+	}
+
+	if !p.skipMonitor {
+		p.monitor.setJobID(resp.JobId)
+	}
+
+	document := &ippclient.DocumentURI{Format: docFormat, URI: server.url}
+	if err := p.sendURI(ctx, printerURI, resp.JobUri, resp.JobId, document); err != nil {
+		return nil, &OperationError{
+			Type: ErrPrintJobSendDocument,
+			Err:  fmt.Errorf("ipp Send-URI failed: %w", err),
+		}
+	}
+
+	if err := server.wait(ctx); err != nil {
+		// Falling back to the next operation sends the document again, this job mustn't print it too.
+		p.cancelJob(printerURI, resp.JobId)
+		return nil, &OperationError{
+			Type: ErrPrintJobSendDocument,
+			Err:  fmt.Errorf("printer didn't fetch the document: %w", err),
+		}
+	}
+
+	return &ippclient.JobAttributes{
+		JobId:           resp.JobId,
+		JobUri:          resp.JobUri,
+		JobState:        resp.JobState,
+		JobStateMessage: resp.JobStateMessage,
+		JobStateReasons: resp.JobStateReasons,
+	}, nil
+}
+
+func (p *ippPrinter) sendURI(ctx context.Context, printerURI, jobURI string, jobID int, document *ippclient.DocumentURI) error {
+	attempts := 0
+	skipBackoff := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if attempts > 0 && !skipBackoff {
+			jitter := mathrand.Int63n(retryBackoffSeconds)
+			<-time.After(time.Duration(retryBackoffSeconds+jitter) * time.Second)
+		}
+		skipBackoff = false
+
+		attempts++
+		if attempts > *ippMaxPrintJobSendDocumentRetryAttempts {
+			p.cancelJob(printerURI, jobID)
+			return fmt.Errorf("max operation retry attempts %d exceeded", *ippMaxPrintJobSendDocumentRetryAttempts)
+		}
+
+		startTime := time.Now()
+		resp, err := p.ippClient.SendURI(printerURI, jobURI, document, lastDocumentFlag, p.Credentials)
+		duration := time.Since(startTime).String()
+
+		if err != nil {
+			pclog.Errorf("failed to send document uri for job %d: %v", jobID, err)
+			if retry, defaultCredentials := p.retryURIOperation(err, sendURIOperation, attempts, duration); retry {
+				skipBackoff = defaultCredentials
+				continue
+			}
+			p.cancelJob(printerURI, jobID)
+			return err
+		}
+
+		if !resp.StatusCode.IsStatusOK() {
+			msg := fmt.Sprintf("Send-URI operation failed with status %s, ippStatus %+v", resp.StatusMessage(), fromSendDocumentResponse(resp))
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(sendURIOperation, attempts, msg, duration)
+
+			// Retrying won't help when the printer doesn't support the operation.
+			statusErr := &ippStatusError{operation: sendURIOperation, status: resp.StatusCode, msg: msg}
+			if ippStatus(resp.StatusCode).Recoverable() && !invalidatesPrinterAttributes(statusErr) {
+				continue
+			}
+			p.cancelJob(printerURI, jobID)
+			return statusErr
+		}
+
+		msg := fmt.Sprintf("send-uri response status code: %v, document uri: %v", resp.StatusCode, document.URI)
+		processingLogger.LogOperationAttempt(sendURIOperation, attempts, msg, duration)
+		return nil
+	}
+}
+
+// PrintURI Print-URI with the URL of the document server. Returns once the printer has fetched the document.
+// IPP/1.1 RFC8011: https://tools.ietf.org/html/rfc8011
+func (p *ippPrinter) PrintURI(ctx context.Context, jobTemplate *ippclient.PrintJobTemplateAttributes, printerURI string, docReader readCloseResetter, docFormat string) (*ippclient.JobAttributes, error) {
+	server, err := serveDocument(printerURI, docReader, docFormat, p.documentFetchTimeout(docReader.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer server.close()
+
+	document := &ippclient.DocumentURI{Format: docFormat, URI: server.url}
+	attempts := 0
+	skipBackoff := false
+	var resp *ippclient.PrintJobResponse
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if attempts > 0 && !skipBackoff {
+			jitter := mathrand.Int63n(retryBackoffSeconds)
+			<-time.After(time.Duration(retryBackoffSeconds+jitter) * time.Second)
+		}
+		skipBackoff = false
+
+		attempts++
+		if attempts > *ippMaxPrintJobSendDocumentRetryAttempts {
+			return nil, &OperationError{
+				Type: ErrPrintIPPPrintJob,
+				Err:  fmt.Errorf("ipp Print-URI failed, err: max operation retry attempts %d exceeded", *ippMaxPrintJobSendDocumentRetryAttempts),
+			}
+		}
+
+		startTime := time.Now()
+		resp, err = p.ippClient.PrintURI(printerURI, document, jobTemplate, p.Credentials)
+		duration := time.Since(startTime).String()
+
+		if err != nil {
+			pclog.Errorf("failed to print uri; err: %v", err)
+			if retry, defaultCredentials := p.retryURIOperation(err, printURIOperation, attempts, duration); retry {
+				skipBackoff = defaultCredentials
+				continue
+			}
+			return nil, &OperationError{
+				Type: ErrPrintIPPPrintJob,
+				Err:  fmt.Errorf("ipp Print-URI failed: %w", err),
+			}
+		}
+
+		if !resp.StatusCode.IsStatusOK() {
+			msg := fmt.Sprintf("Print-URI operation failed with status %s", resp.StatusMessage())
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(printURIOperation, attempts, msg, duration)
+
+			// Retrying won't help when the printer doesn't support the operation.
+			statusErr := &ippStatusError{operation: printURIOperation, status: resp.StatusCode, msg: msg}
+			if ippStatus(resp.StatusCode).Recoverable() && !invalidatesPrinterAttributes(statusErr) {
+				continue
+			}
+			return nil, &OperationError{
+				Type: ErrPrintIPPPrintJob,
+				Err:  fmt.Errorf("ipp Print-URI failed: %w", statusErr),
+			}
+		}
+
+		if resp.JobId <= 0 || resp.JobId > math.MaxInt32 {
+			return nil, &OperationError{
+				Type: ErrPrintIPPPrintJob,
+				Err:  fmt.Errorf("ipp Print-URI failed: invalid job-id %v", resp.JobId),
+			}
+		}
+
+		msg := fmt.Sprintf("print-uri response status code: %v, jobId: %v, document uri: %v", resp.StatusCode, resp.JobId, document.URI)
+		processingLogger.LogOperationAttempt(printURIOperation, attempts, msg, duration)
+		break
+	}
+
+	if !p.skipMonitor {
+		p.monitor.setJobID(resp.JobId)
+	}
+
+	if err := server.wait(ctx); err != nil {
+		// Falling back to the next operation sends the document again, this job mustn't print it too.
+		p.cancelJob(printerURI, resp.JobId)
+		return nil, &OperationError{
+			Type: ErrPrintIPPPrintJob,
+			Err:  fmt.Errorf("printer didn't fetch the document: %w", err),
+		}
+	}
+
+	return &ippclient.JobAttributes{
+		JobId:           resp.JobId,
+		JobUri:          resp.JobUri,
+		JobState:        resp.JobState,
+		JobStateMessage: resp.JobStateMessage,
+		JobStateReasons: resp.JobStateReasons,
+	}, nil
+}
+
+// retryURIOperation Whether a failed Send-URI or Print-URI request is tried again: on HTTP 401, first with the
+// default credentials, then up to -ippMaxUnauthorisedAttempts times, or on a temporary network error.
+// defaultCredentials is set when switching to the default credentials, which is retried without a backoff.
+func (p *ippPrinter) retryURIOperation(err error, operation string, attempts int, duration string) (retry, defaultCredentials bool) {
+	if reqErr, isHttpStatusError := ippclient.IsHTTPStatusError(err); isHttpStatusError && reqErr != nil &&
+		reqErr.StatusCode == http.StatusUnauthorized {
+		if p.Credentials == nil {
+			msg := "retry with default ipp credentials"
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(operation, attempts, msg, duration)
+			p.Credentials = defaultIppCredentials
+			return true, true
+		}
+
+		// CUPS retries 4 times on HTTP 401 most probably to get around printer quirks
+		// we're trying to mimic its behaviour here by retrying a set number of times.
+		if attempts <= *ippMaxUnauthorisedAttempts {
+			msg := fmt.Sprintf("%s received HTTP 401; trying again - attempt %d/%d", operation, attempts, *ippMaxUnauthorisedAttempts)
+			pclog.Supportf(msg)
+			processingLogger.LogOperationAttempt(operation, attempts, msg, duration)
+			return true, false
+		}
+		processingLogger.LogOperationAttempt(operation, attempts, err.Error(), duration)
+		return false, false
+	}
+
+	ippErr := &ippJobOpError{error: err}
+	if ippErr.Temporary() {
+		msg := fmt.Sprintf("encountered temporary network error: %v", ippErr)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(operation, attempts, msg, duration)
+		return true, false
+	}
+
+	processingLogger.LogOperationAttempt(operation, attempts, err.Error(), duration)
+	return false, false
+}
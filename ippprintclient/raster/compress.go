@@ -0,0 +1,67 @@
+package raster
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// writeLines Write the page's lines compressed as PWG Raster and URF do: a line repeat count, then the
+// line's pixels run length encoded, runs of up to 128 repeated pixels or up to 128 literal pixels.
+func writeLines(w *bufio.Writer, page *Page, bpp int) error {
+	lineLength := page.Width * bpp
+	line := func(y int) []byte {
+		return page.Pixels[y*lineLength : (y+1)*lineLength]
+	}
+
+	for y := 0; y < page.Height; {
+		repeat := 0
+		for y+repeat+1 < page.Height && repeat < 255 && bytes.Equal(line(y), line(y+repeat+1)) {
+			repeat++
+		}
+		if err := w.WriteByte(byte(repeat)); err != nil {
+			return err
+		}
+		if err := writeLine(w, line(y), bpp); err != nil {
+			return err
+		}
+		y += repeat + 1
+	}
+	return nil
+}
+
+func writeLine(w *bufio.Writer, line []byte, bpp int) error {
+	pixels := len(line) / bpp
+	pixel := func(i int) []byte {
+		return line[i*bpp : (i+1)*bpp]
+	}
+
+	for i := 0; i < pixels; {
+		run := 1
+		for i+run < pixels && run < 128 && bytes.Equal(pixel(i), pixel(i+run)) {
+			run++
+		}
+		if run > 1 || i+1 == pixels {
+			_ = w.WriteByte(byte(run - 1))
+			_, _ = w.Write(pixel(i))
+			i += run
+			continue
+		}
+
+		// Literal pixels, up to the start of the next run.
+		count := 1
+		for i+count < pixels && count < 128 && (i+count+1 == pixels || !bytes.Equal(pixel(i+count), pixel(i+count+1))) {
+			count++
+		}
+		if count == 1 {
+			_ = w.WriteByte(0)
+		} else {
+			_ = w.WriteByte(byte(257 - count))
+		}
+		_, err := w.Write(line[i*bpp : (i+count)*bpp])
+		if err != nil {
+			return err
+		}
+		i += count
+	}
+	return nil
+}
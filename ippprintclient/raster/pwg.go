@@ -0,0 +1,104 @@
+package raster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	pwgSyncWord   = "RaS2"
+	pwgHeaderSize = 1796
+
+	// cupsColorSpace values.
+	pwgColorSpaceSGray = 18
+	pwgColorSpaceSRGB  = 19
+)
+
+// Offsets of the PWG 5102.4 page header fields written.
+const (
+	pwgOffsetMediaType       = 128
+	pwgOffsetDuplex          = 272
+	pwgOffsetHWResolution    = 276
+	pwgOffsetNumCopies       = 340
+	pwgOffsetPageSize        = 352
+	pwgOffsetTumble          = 368
+	pwgOffsetWidth           = 372
+	pwgOffsetHeight          = 376
+	pwgOffsetBitsPerColor    = 384
+	pwgOffsetBitsPerPixel    = 388
+	pwgOffsetBytesPerLine    = 392
+	pwgOffsetColorSpace      = 400
+	pwgOffsetNumColors       = 420
+	pwgOffsetTotalPageCount  = 452
+	pwgOffsetCrossFeed       = 456
+	pwgOffsetFeed            = 460
+	pwgOffsetPrintQuality    = 484
+	pwgOffsetRenderingIntent = 1668
+	pwgOffsetPageSizeName    = 1732
+)
+
+func writePWG(w io.Writer, pages []*Page, opts *Options) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(pwgSyncWord); err != nil {
+		return err
+	}
+
+	bpp := opts.bytesPerPixel()
+	for i, page := range pages {
+		crossFeed, feed := 1, 1
+		if opts.backSide(i) {
+			crossFeed, feed = opts.backSideTransform()
+		}
+
+		header := make([]byte, pwgHeaderSize)
+		putString(header, pwgOffsetMediaType, "auto")
+		putUint32(header, pwgOffsetDuplex, boolValue(opts.duplex()))
+		putUint32(header, pwgOffsetHWResolution, uint32(opts.XRes))
+		putUint32(header, pwgOffsetHWResolution+4, uint32(opts.YRes))
+		putUint32(header, pwgOffsetNumCopies, 1)
+		// PageSize is in points.
+		putUint32(header, pwgOffsetPageSize, uint32(opts.MediaWidth*72/2540))
+		putUint32(header, pwgOffsetPageSize+4, uint32(opts.MediaHeight*72/2540))
+		putUint32(header, pwgOffsetTumble, boolValue(opts.tumble()))
+		putUint32(header, pwgOffsetWidth, uint32(page.Width))
+		putUint32(header, pwgOffsetHeight, uint32(page.Height))
+		putUint32(header, pwgOffsetBitsPerColor, 8)
+		putUint32(header, pwgOffsetBitsPerPixel, uint32(8*bpp))
+		putUint32(header, pwgOffsetBytesPerLine, uint32(page.Width*bpp))
+		if bpp == 3 {
+			putUint32(header, pwgOffsetColorSpace, pwgColorSpaceSRGB)
+		} else {
+			putUint32(header, pwgOffsetColorSpace, pwgColorSpaceSGray)
+		}
+		putUint32(header, pwgOffsetNumColors, uint32(bpp))
+		putUint32(header, pwgOffsetTotalPageCount, uint32(len(pages)))
+		putUint32(header, pwgOffsetCrossFeed, uint32(int32(crossFeed)))
+		putUint32(header, pwgOffsetFeed, uint32(int32(feed)))
+		putUint32(header, pwgOffsetPrintQuality, 0)
+		putString(header, pwgOffsetRenderingIntent, "auto")
+
+		if _, err := bw.Write(header); err != nil {
+			return err
+		}
+		if err := writeLines(bw, page.transform(crossFeed, feed, bpp), bpp); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func putUint32(b []byte, offset int, v uint32) {
+	binary.BigEndian.PutUint32(b[offset:offset+4], v)
+}
+
+func putString(b []byte, offset int, s string) {
+	copy(b[offset:offset+63], s)
+}
+
+func boolValue(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+// Package raster renders images into PWG Raster (PWG 5102.4) and Apple URF documents, the formats
+// AirPrint and IPP Everywhere printers are guaranteed to accept.
+package raster
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+
+	// Decoders for the images Render accepts.
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Document formats written by Write.
+const (
+	FormatPWG = "image/pwg-raster"
+	FormatURF = "image/urf"
+)
+
+// Color spaces, named as in pwg-raster-document-type-supported.
+const (
+	ColorSpaceGray = "sgray_8"
+	ColorSpaceRGB  = "srgb_8"
+)
+
+// Back side handling of two sided documents, named as in pwg-raster-document-sheet-back.
+const (
+	SheetBackNormal       = "normal"
+	SheetBackFlipped      = "flipped"
+	SheetBackRotated      = "rotated"
+	SheetBackManualTumble = "manual-tumble"
+)
+
+// Sides, named as in the sides job attribute.
+const (
+	SidesOneSided          = "one-sided"
+	SidesTwoSidedLongEdge  = "two-sided-long-edge"
+	SidesTwoSidedShortEdge = "two-sided-short-edge"
+)
+
+// ErrUnsupportedFormat The document isn't an image Render can decode.
+var ErrUnsupportedFormat = errors.New("raster: unsupported image format")
+
+// Options How to render a document.
+type Options struct {
+	Format     string // FormatPWG or FormatURF
+	XRes, YRes int    // Dots per inch
+	// Media size in hundredths of a millimetre, the unit of the IPP media-size collection.
+	MediaWidth, MediaHeight int
+	ColorSpace              string // ColorSpaceGray or ColorSpaceRGB
+	Sides                   string
+	SheetBack               string
+}
+
+// Page A rendered page, rows of pixels with one byte per color.
+type Page struct {
+	Width, Height int
+	Pixels        []byte
+}
+
+func (o *Options) bytesPerPixel() int {
+	if o.ColorSpace == ColorSpaceRGB {
+		return 3
+	}
+	return 1
+}
+
+func (o *Options) duplex() bool {
+	return o.Sides == SidesTwoSidedLongEdge || o.Sides == SidesTwoSidedShortEdge
+}
+
+func (o *Options) tumble() bool {
+	return o.Sides == SidesTwoSidedShortEdge
+}
+
+// pageSize The page size in pixels.
+func (o *Options) pageSize() (int, int) {
+	return o.MediaWidth * o.XRes / 2540, o.MediaHeight * o.YRes / 2540
+}
+
+// Decode Decode a JPEG or PNG image.
+func Decode(r io.Reader) (image.Image, error) {
+	img, _, err := image.Decode(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, ErrUnsupportedFormat
+	}
+	return img, err
+}
+
+// Render Render an image onto a page of the media size. The image is scaled to fit the page keeping its
+// aspect ratio, centred, and rotated if its orientation doesn't match the page's.
+func Render(img image.Image, opts *Options) *Page {
+	width, height := opts.pageSize()
+	bpp := opts.bytesPerPixel()
+	page := &Page{Width: width, Height: height, Pixels: make([]byte, width*height*bpp)}
+	for i := range page.Pixels {
+		page.Pixels[i] = 0xff
+	}
+
+	bounds := img.Bounds()
+	imgWidth, imgHeight := bounds.Dx(), bounds.Dy()
+	if imgWidth == 0 || imgHeight == 0 || width == 0 || height == 0 {
+		return page
+	}
+
+	rotate := (imgWidth > imgHeight) != (width > height)
+	if rotate {
+		imgWidth, imgHeight = imgHeight, imgWidth
+	}
+
+	// Scale to fit, then centre.
+	scaledWidth, scaledHeight := width, imgHeight*width/imgWidth
+	if scaledHeight > height {
+		scaledWidth, scaledHeight = imgWidth*height/imgHeight, height
+	}
+	left, top := (width-scaledWidth)/2, (height-scaledHeight)/2
+
+	for y := 0; y < scaledHeight; y++ {
+		for x := 0; x < scaledWidth; x++ {
+			// Nearest neighbour sampling.
+			sx, sy := x*imgWidth/scaledWidth, y*imgHeight/scaledHeight
+			if rotate {
+				sx, sy = sy, imgWidth-1-sx
+			}
+			c := img.At(bounds.Min.X+sx, bounds.Min.Y+sy)
+
+			offset := ((top+y)*width + left + x) * bpp
+			if bpp == 1 {
+				page.Pixels[offset] = color.GrayModel.Convert(c).(color.Gray).Y
+			} else {
+				rgb := color.RGBAModel.Convert(c).(color.RGBA)
+				page.Pixels[offset], page.Pixels[offset+1], page.Pixels[offset+2] = blend(rgb.R, rgb.A), blend(rgb.G, rgb.A), blend(rgb.B, rgb.A)
+			}
+		}
+	}
+	return page
+}
+
+// blend Blend a premultiplied color channel onto white paper.
+func blend(v, alpha uint8) uint8 {
+	return v + 0xff - alpha
+}
+
+// backSideTransform How the back side of a two sided sheet is mirrored, across the feed and along it,
+// 1 for unchanged and -1 for mirrored. See PWG 5102.4 CrossFeedTransform and FeedTransform.
+func (o *Options) backSideTransform() (crossFeed, feed int) {
+	switch o.SheetBack {
+	case SheetBackFlipped:
+		if o.tumble() {
+			return -1, 1
+		}
+		return 1, -1
+	case SheetBackManualTumble:
+		if o.tumble() {
+			return -1, -1
+		}
+	case SheetBackRotated:
+		if !o.tumble() {
+			return -1, -1
+		}
+	}
+	return 1, 1
+}
+
+// transform Mirror a page across and along the feed direction.
+func (p *Page) transform(crossFeed, feed, bpp int) *Page {
+	if crossFeed == 1 && feed == 1 {
+		return p
+	}
+
+	out := &Page{Width: p.Width, Height: p.Height, Pixels: make([]byte, len(p.Pixels))}
+	for y := 0; y < p.Height; y++ {
+		sy := y
+		if feed == -1 {
+			sy = p.Height - 1 - y
+		}
+		for x := 0; x < p.Width; x++ {
+			sx := x
+			if crossFeed == -1 {
+				sx = p.Width - 1 - x
+			}
+			copy(out.Pixels[(y*p.Width+x)*bpp:(y*p.Width+x+1)*bpp], p.Pixels[(sy*p.Width+sx)*bpp:(sy*p.Width+sx+1)*bpp])
+		}
+	}
+	return out
+}
+
+// Write Write the pages as a PWG Raster or URF document. Back sides of two sided documents are
+// transformed as the printer's sheet back requires.
+func Write(w io.Writer, pages []*Page, opts *Options) error {
+	switch opts.Format {
+	case FormatPWG:
+		return writePWG(w, pages, opts)
+	case FormatURF:
+		return writeURF(w, pages, opts)
+	}
+	return errors.New("raster: unsupported output format " + opts.Format)
+}
+
+// backSide Whether the page, counting from 0, is printed on the back of a sheet.
+func (o *Options) backSide(index int) bool {
+	return o.duplex() && index%2 == 1
+}
@@ -0,0 +1,138 @@
+package raster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// decodeLines Decode a compressed page, the inverse of writeLines.
+func decodeLines(t *testing.T, data []byte, width, height, bpp int) ([]byte, []byte) {
+	var pixels []byte
+	for lines := 0; lines < height; {
+		repeat := int(data[0]) + 1
+		data = data[1:]
+		var line []byte
+		for len(line) < width*bpp {
+			n := int(data[0])
+			data = data[1:]
+			if n <= 127 {
+				for i := 0; i <= n; i++ {
+					line = append(line, data[:bpp]...)
+				}
+				data = data[bpp:]
+			} else {
+				count := 257 - n
+				line = append(line, data[:count*bpp]...)
+				data = data[count*bpp:]
+			}
+		}
+		if len(line) != width*bpp {
+			t.Fatalf("line overruns the page width: %d", len(line))
+		}
+		for i := 0; i < repeat; i++ {
+			pixels = append(pixels, line...)
+		}
+		lines += repeat
+	}
+	return pixels, data
+}
+
+func TestWriteLines_RoundTrip(t *testing.T) {
+	page := &Page{Width: 300, Height: 4, Pixels: make([]byte, 300*4*3)}
+	for i := range page.Pixels {
+		// Runs, literals and repeated lines.
+		switch {
+		case i < 300*3:
+			page.Pixels[i] = byte(i * 7)
+		case i < 300*3*2:
+			page.Pixels[i] = 0x40
+		default:
+			page.Pixels[i] = byte(i / 9)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, []*Page{page}, &Options{Format: FormatURF, XRes: 300, YRes: 300, ColorSpace: ColorSpaceRGB}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := buf.Bytes()
+	if string(data[:8]) != urfMagic || binary.BigEndian.Uint32(data[8:]) != 1 {
+		t.Fatalf("bad urf header: %q", data[:12])
+	}
+	pageHeader := data[12 : 12+urfPageHeaderSize]
+	if pageHeader[0] != 24 || pageHeader[1] != urfColorSpaceSRGB || binary.BigEndian.Uint32(pageHeader[12:]) != 300 {
+		t.Fatalf("bad urf page header: %v", pageHeader)
+	}
+
+	pixels, rest := decodeLines(t, data[12+urfPageHeaderSize:], page.Width, page.Height, 3)
+	if !bytes.Equal(pixels, page.Pixels) || len(rest) != 0 {
+		t.Fatalf("decoded page doesn't match, %d bytes left over", len(rest))
+	}
+}
+
+func TestWritePWG_BackSide(t *testing.T) {
+	front := &Page{Width: 2, Height: 2, Pixels: []byte{1, 2, 3, 4}}
+	back := &Page{Width: 2, Height: 2, Pixels: []byte{1, 2, 3, 4}}
+	opts := &Options{Format: FormatPWG, XRes: 300, YRes: 300, MediaWidth: 21000, MediaHeight: 29700,
+		ColorSpace: ColorSpaceGray, Sides: SidesTwoSidedLongEdge, SheetBack: SheetBackRotated}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, []*Page{front, back}, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := buf.Bytes()
+	if string(data[:4]) != pwgSyncWord {
+		t.Fatalf("bad sync word: %q", data[:4])
+	}
+
+	header := data[4 : 4+pwgHeaderSize]
+	if binary.BigEndian.Uint32(header[pwgOffsetDuplex:]) != 1 || binary.BigEndian.Uint32(header[pwgOffsetPageSize:]) != 595 ||
+		binary.BigEndian.Uint32(header[pwgOffsetColorSpace:]) != pwgColorSpaceSGray || binary.BigEndian.Uint32(header[pwgOffsetTotalPageCount:]) != 2 {
+		t.Fatalf("bad pwg page header")
+	}
+	pixels, rest := decodeLines(t, data[4+pwgHeaderSize:], 2, 2, 1)
+	if !bytes.Equal(pixels, front.Pixels) {
+		t.Fatalf("front side shouldn't be transformed, got %v", pixels)
+	}
+
+	header = rest[:pwgHeaderSize]
+	if int32(binary.BigEndian.Uint32(header[pwgOffsetCrossFeed:])) != -1 || int32(binary.BigEndian.Uint32(header[pwgOffsetFeed:])) != -1 {
+		t.Fatalf("expected rotated back side transforms")
+	}
+	pixels, _ = decodeLines(t, rest[pwgHeaderSize:], 2, 2, 1)
+	if !bytes.Equal(pixels, []byte{4, 3, 2, 1}) {
+		t.Fatalf("expected back side rotated, got %v", pixels)
+	}
+}
+
+func TestRender_FitsAndRotates(t *testing.T) {
+	// A black landscape image on a portrait page is rotated to fill the page width.
+	img := image.NewGray(image.Rect(0, 0, 200, 100))
+	for i := range img.Pix {
+		img.Pix[i] = 0
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded, err := Decode(&encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	page := Render(decoded, &Options{XRes: 254, YRes: 254, MediaWidth: 1000, MediaHeight: 4000, ColorSpace: ColorSpaceGray})
+	if page.Width != 100 || page.Height != 400 {
+		t.Fatalf("unexpected page size %dx%d", page.Width, page.Height)
+	}
+	// 100 wide, 200 high, centred vertically.
+	if page.Pixels[0] != 0xff || page.Pixels[100*100] != 0 || page.Pixels[100*299+99] != 0 || page.Pixels[100*300] != 0xff {
+		t.Fatalf("image not fitted to the page")
+	}
+
+	if _, err := Decode(bytes.NewReader([]byte("%PDF-1.7"))); err != ErrUnsupportedFormat {
+		t.Fatalf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
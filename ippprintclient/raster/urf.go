@@ -0,0 +1,68 @@
+package raster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	urfMagic          = "UNIRAST\x00"
+	urfPageHeaderSize = 32
+
+	// Color spaces.
+	urfColorSpaceSGray = 0
+	urfColorSpaceSRGB  = 1
+
+	// Duplex modes.
+	urfDuplexNone      = 1
+	urfDuplexShortEdge = 2
+	urfDuplexLongEdge  = 3
+
+	urfQualityNormal = 4
+)
+
+func writeURF(w io.Writer, pages []*Page, opts *Options) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(urfMagic)+4)
+	copy(header, urfMagic)
+	binary.BigEndian.PutUint32(header[len(urfMagic):], uint32(len(pages)))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	bpp := opts.bytesPerPixel()
+	duplex := byte(urfDuplexNone)
+	if opts.tumble() {
+		duplex = urfDuplexShortEdge
+	} else if opts.duplex() {
+		duplex = urfDuplexLongEdge
+	}
+	colorSpace := byte(urfColorSpaceSGray)
+	if bpp == 3 {
+		colorSpace = urfColorSpaceSRGB
+	}
+
+	for i, page := range pages {
+		pageHeader := make([]byte, urfPageHeaderSize)
+		pageHeader[0] = byte(8 * bpp)
+		pageHeader[1] = colorSpace
+		pageHeader[2] = duplex
+		pageHeader[3] = urfQualityNormal
+		binary.BigEndian.PutUint32(pageHeader[12:], uint32(page.Width))
+		binary.BigEndian.PutUint32(pageHeader[16:], uint32(page.Height))
+		binary.BigEndian.PutUint32(pageHeader[20:], uint32(opts.XRes))
+		if _, err := bw.Write(pageHeader); err != nil {
+			return err
+		}
+
+		crossFeed, feed := 1, 1
+		if opts.backSide(i) {
+			crossFeed, feed = opts.backSideTransform()
+		}
+		if err := writeLines(bw, page.transform(crossFeed, feed, bpp), bpp); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,148 @@
+package ippprintclient
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/raster"
+)
+
+// Image formats rasterised when the printer doesn't take them as is.
+var rasterisableFormats = []string{"image/jpeg", "image/png"}
+
+// Raster formats images are converted to, in order of preference.
+var rasterFormats = []string{raster.FormatPWG, raster.FormatURF}
+
+// The resolution rasterised at if the printer supports it, otherwise the nearest it does.
+const preferredRasterResolution = 300
+
+// urf-supported keywords, see the AirPrint specification.
+var (
+	urfResolutionRegex = regexp.MustCompile(`^RS(\d+(?:-\d+)*)$`)
+	urfSheetBack       = map[string]string{
+		"DM1": raster.SheetBackNormal,
+		"DM2": raster.SheetBackFlipped,
+		"DM3": raster.SheetBackRotated,
+		"DM4": raster.SheetBackManualTumble,
+	}
+)
+
+const (
+	urfColorRGB = "SRGB24"
+	dpcmPerInch = 2.54
+)
+
+// selectRasterFormat The raster format to convert the ticket's document to, "" if it isn't an image that can be
+// rasterised or the printer takes neither PWG Raster nor URF.
+func selectRasterFormat(ticketAttrs *jobticket.JobTicket, printerAttrs *ippclient.PrinterAttributes) string {
+	if !containsFold(rasterisableFormats, strings.TrimSpace(ticketAttrs.DocumentFormat)) {
+		return ""
+	}
+	for _, format := range rasterFormats {
+		if containsFold(printerAttrs.DocumentFormatSupported, format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// rasterOptions How to rasterise the document for a job: at a resolution the printer supports, on the job's media,
+// in color only if the job and the printer are, with back sides as the printer expects them.
+func rasterOptions(format string, jobAttrs *ippclient.PrintJobTemplateAttributes, printerAttrs *ippclient.PrinterAttributes) *raster.Options {
+	opts := &raster.Options{
+		Format:     format,
+		ColorSpace: raster.ColorSpaceGray,
+		Sides:      jobAttrs.AttributesSides,
+		SheetBack:  raster.SheetBackNormal,
+	}
+	opts.MediaWidth, opts.MediaHeight = jobMediaSize(jobAttrs)
+	color := jobAttrs.PrintColorMode != colorModeMonochrome
+
+	var resolutions [][2]int
+	if format == raster.FormatPWG {
+		for _, resolution := range printerAttrs.PwgRasterDocumentResolutionSupported {
+			x, y := resolution.XRes, resolution.YRes
+			if resolution.Units == resolutionUnits["dpcm"] {
+				x, y = int(math.Round(float64(x)*dpcmPerInch)), int(math.Round(float64(y)*dpcmPerInch))
+			}
+			resolutions = append(resolutions, [2]int{x, y})
+		}
+		if color && containsFold(printerAttrs.PwgRasterDocumentTypeSupported, raster.ColorSpaceRGB) {
+			opts.ColorSpace = raster.ColorSpaceRGB
+		}
+		if printerAttrs.PwgRasterDocumentSheetBack != "" {
+			opts.SheetBack = printerAttrs.PwgRasterDocumentSheetBack
+		}
+	} else {
+		for _, keyword := range printerAttrs.UrfSupported {
+			if match := urfResolutionRegex.FindStringSubmatch(keyword); match != nil {
+				for _, value := range strings.Split(match[1], "-") {
+					dpi, _ := strconv.Atoi(value)
+					resolutions = append(resolutions, [2]int{dpi, dpi})
+				}
+			}
+			if sheetBack, ok := urfSheetBack[keyword]; ok {
+				opts.SheetBack = sheetBack
+			}
+		}
+		if color && containsFold(printerAttrs.UrfSupported, urfColorRGB) {
+			opts.ColorSpace = raster.ColorSpaceRGB
+		}
+	}
+
+	opts.XRes, opts.YRes = preferredRasterResolution, preferredRasterResolution
+	nearest := math.MaxInt32
+	for _, resolution := range resolutions {
+		distance := abs(resolution[0]-preferredRasterResolution) + abs(resolution[1]-preferredRasterResolution)
+		if distance < nearest {
+			nearest = distance
+			opts.XRes, opts.YRes = resolution[0], resolution[1]
+		}
+	}
+	return opts
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// rasteriseDocument Decode the image and spool it rasterised as opts say. The returned cleanup removes the spool file.
+func rasteriseDocument(tmpDir string, document io.Reader, opts *raster.Options) (readCloseResetter, func(), error) {
+	img, err := raster.Decode(document)
+	if err != nil {
+		return nil, nil, &OperationError{
+			Type: ErrPrintDefaultError,
+			Err:  fmt.Errorf("failed to decode image: %v", err),
+		}
+	}
+	page := raster.Render(img, opts)
+	pclog.Devf("rasterised %dx%d image to %dx%d %s page at %dx%ddpi",
+		img.Bounds().Dx(), img.Bounds().Dy(), page.Width, page.Height, opts.ColorSpace, opts.XRes, opts.YRes)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(raster.Write(pw, []*raster.Page{page}, opts))
+	}()
+	docReader, cleanupSpool, err := spoolDocument(tmpDir, pr, -1)
+	if err != nil {
+		_ = pr.Close()
+		return nil, nil, err
+	}
+
+	// Closing the pipe stops the writer if the job fails before the whole document is sent.
+	cleanup := func() {
+		_ = pr.Close()
+		cleanupSpool()
+	}
+	return docReader, cleanup, nil
+}
@@ -0,0 +1,135 @@
+package ippprintclient
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// Number of bytes at the start of the document looked at to detect its format. Big enough for a PJL header.
+const sniffLength = 4096
+
+// What to do when the detected document format doesn't match the ticket.
+const (
+	documentFormatMismatchWarn = "warn" // Log it and print with the ticket's format.
+	documentFormatMismatchFail = "fail" // Fail the job with ErrPrintDocFormatSniffMismatch.
+)
+
+const documentFormatOctetStream = "application/octet-stream"
+
+// PJL Universal Exit Language, starts PJL headers.
+var pjlUEL = []byte("\x1b%-12345X")
+
+var pjlEnterLanguageRegex = regexp.MustCompile(`(?i)@PJL\s+ENTER\s+LANGUAGE\s*=\s*([A-Z0-9]+)`)
+
+var pjlLanguageFormats = map[string]string{
+	"PCL":        "application/vnd.hp-PCL",
+	"PCLXL":      "application/vnd.hp-PCLXL",
+	"POSTSCRIPT": "application/postscript",
+	"PDF":        "application/pdf",
+}
+
+var documentSignatures = []struct {
+	signature []byte
+	format    string
+}{
+	{[]byte("%PDF-"), "application/pdf"},
+	{[]byte("%!"), "application/postscript"},
+	{[]byte("\x04%!"), "application/postscript"},
+	{[]byte(") HP-PCL XL;"), "application/vnd.hp-PCLXL"},
+	{[]byte("\x1bE"), "application/vnd.hp-PCL"},
+	{[]byte("UNIRAST\x00"), "image/urf"},
+	{[]byte("RaS2"), "image/pwg-raster"},
+	{[]byte("\xff\xd8\xff"), "image/jpeg"},
+	{[]byte("\x89PNG\r\n\x1a\n"), "image/png"},
+}
+
+// Document formats known by more than one name, mapped to a single name.
+var documentFormatAliases = map[string]string{
+	"application/pcl":  "application/vnd.hp-pcl",
+	"application/pcl6": "application/vnd.hp-pclxl",
+	"application/ps":   "application/postscript",
+}
+
+// sniffDocumentFormat Detect the document format from the start of the document, "" if it isn't recognised.
+// PJL wrapped documents are detected by their ENTER LANGUAGE command, or the data after the PJL header.
+func sniffDocumentFormat(head []byte) string {
+	if bytes.HasPrefix(head, pjlUEL) {
+		if match := pjlEnterLanguageRegex.FindSubmatch(head); match != nil {
+			if format, ok := pjlLanguageFormats[strings.ToUpper(string(match[1]))]; ok {
+				return format
+			}
+		}
+		return sniffDocumentFormat(skipPJLHeader(head[len(pjlUEL):]))
+	}
+
+	for _, s := range documentSignatures {
+		if bytes.HasPrefix(head, s.signature) {
+			return s.format
+		}
+	}
+	return ""
+}
+
+// skipPJLHeader Skip the @PJL command lines at the start of the data.
+func skipPJLHeader(data []byte) []byte {
+	for bytes.HasPrefix(bytes.TrimLeft(data, "\r\n"), []byte("@PJL")) {
+		data = bytes.TrimLeft(data, "\r\n")
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return nil
+		}
+		data = data[end+1:]
+	}
+	return data
+}
+
+func sameDocumentFormat(a, b string) bool {
+	canonical := func(format string) string {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if alias, ok := documentFormatAliases[format]; ok {
+			return alias
+		}
+		return format
+	}
+	return canonical(a) == canonical(b)
+}
+
+// reconcileDocumentFormat Compare the ticket's document format with the one detected from the start of the
+// document. application/octet-stream tickets get the detected format. Other mismatches are logged, or fail
+// with ErrPrintDocFormatSniffMismatch if failOnMismatch.
+func reconcileDocumentFormat(ticketAttrs *jobticket.JobTicket, head []byte, failOnMismatch bool) error {
+	detected := sniffDocumentFormat(head)
+	if detected == "" {
+		pclog.Devf("document format not detected, using ticket format %s", ticketAttrs.DocumentFormat)
+		return nil
+	}
+
+	if sameDocumentFormat(ticketAttrs.DocumentFormat, detected) {
+		return nil
+	}
+
+	if sameDocumentFormat(ticketAttrs.DocumentFormat, documentFormatOctetStream) {
+		msg := fmt.Sprintf("document format %s detected for %s ticket", detected, documentFormatOctetStream)
+		pclog.Supportf(msg)
+		processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+		ticketAttrs.DocumentFormat = detected
+		return nil
+	}
+
+	msg := fmt.Sprintf("document format mismatch: ticket=%s detected=%s", ticketAttrs.DocumentFormat, detected)
+	processingLogger.LogOperationAttempt(printJobOperation, 1, msg, "")
+	if failOnMismatch {
+		pclog.Errorf(msg)
+		return &OperationError{
+			Type: ErrPrintDocFormatSniffMismatch,
+			Err:  fmt.Errorf("%s", msg),
+		}
+	}
+	pclog.Supportf(msg)
+	return nil
+}
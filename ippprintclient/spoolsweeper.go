@@ -0,0 +1,144 @@
+package ippprintclient
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/filelock"
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/util/config"
+)
+
+// spoolSweep What a spool sweep did.
+type spoolSweep struct {
+	removed   int   // Orphaned spool files removed
+	reclaimed int64 // Bytes freed by removing them
+	inUse     int   // Spool files old enough to remove, but locked by a live process
+	kept      int   // Spool files younger than the age threshold
+}
+
+// sweepSpool Remove spool files in dir older than maxAge that no live process holds the lock of, left behind
+// by a process that crashed or was killed before cleaning up. Spool files are overwritten before removal.
+// Lock files left without their spool file are removed too.
+func sweepSpool(dir string, maxAge time.Duration, now time.Time) (*spoolSweep, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, spoolFilePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	sweep := &spoolSweep{}
+	var lockPaths []string
+	for _, path := range paths {
+		if strings.HasSuffix(path, spoolLockSuffix) {
+			lockPaths = append(lockPaths, path)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if now.Sub(info.ModTime()) < maxAge {
+			sweep.kept++
+			continue
+		}
+
+		lock, ok, err := filelock.TryLock(path + spoolLockSuffix)
+		if err != nil {
+			pclog.Devf("spool sweep: failed to lock %v: %v", path, err)
+			continue
+		}
+		if !ok {
+			sweep.inUse++
+			continue
+		}
+
+		if err := removeSpoolFile(path, info.Size()); err != nil {
+			pclog.Devf("spool sweep: failed to remove %v: %v", path, err)
+		} else {
+			sweep.removed++
+			sweep.reclaimed += info.Size()
+		}
+		_ = lock.Release()
+		_ = os.Remove(path + spoolLockSuffix)
+	}
+
+	for _, lockPath := range lockPaths {
+		if _, err := os.Stat(strings.TrimSuffix(lockPath, spoolLockSuffix)); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		info, err := os.Stat(lockPath)
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		lock, ok, err := filelock.TryLock(lockPath)
+		if err != nil || !ok {
+			continue
+		}
+		_ = lock.Release()
+		_ = os.Remove(lockPath)
+	}
+
+	return sweep, nil
+}
+
+// removeSpoolFile Overwrite a spool file with zeros and remove it.
+func removeSpoolFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	overwriteFile(file, size)
+	if err := file.Close(); err != nil {
+		pclog.Devf("err=%v", err)
+	}
+	return os.Remove(path)
+}
+
+// sweepSpoolOnStart Sweep orphaned spool files out of the spool directory before spooling a new document.
+// Failures are logged, they never stop the job.
+func sweepSpoolOnStart() {
+	sweep, err := sweepSpool(config.TmpDir, time.Duration(*spoolSweepAgeSec)*time.Second, time.Now())
+	if err != nil {
+		pclog.Devf("spool sweep failed: %v", err)
+		return
+	}
+	if sweep.removed > 0 {
+		pclog.Supportf("spool sweep: removed %d orphaned spool files, reclaimed %d bytes", sweep.removed, sweep.reclaimed)
+		processingLogger.LogOperationAttempt(printJobOperation, 1,
+			fmt.Sprintf("spool sweep: removed %d orphaned spool files, reclaimed %d bytes", sweep.removed, sweep.reclaimed), "")
+	}
+}
+
+// cleanupSpoolCommand Sweep orphaned spool files out of the spool directory, reporting what was removed on w.
+func cleanupSpoolCommand(w io.Writer, args []string, tmpDir string) error {
+	opErr := &OperationError{
+		Type: ErrCleanupSpool,
+	}
+
+	flags := flag.NewFlagSet("cleanup-spool", flag.ContinueOnError)
+	maxAgeSec := flags.Int("maxAgeSec", *spoolSweepAgeSec, "remove unlocked spool files older than this")
+	if err := flags.Parse(args); err != nil {
+		opErr.Err = err
+		return opErr
+	}
+
+	sweep, err := sweepSpool(tmpDir, time.Duration(*maxAgeSec)*time.Second, time.Now())
+	if err != nil {
+		opErr.Err = err
+		return opErr
+	}
+
+	_, _ = fmt.Fprintf(w, "removed %d orphaned spool files, reclaimed %d bytes\n", sweep.removed, sweep.reclaimed)
+	_, _ = fmt.Fprintf(w, "kept %d spool files in use and %d younger than %ds\n", sweep.inUse, sweep.kept, *maxAgeSec)
+	return nil
+}
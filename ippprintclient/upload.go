@@ -0,0 +1,158 @@
+package ippprintclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"bitbucket.org/papercutsoftware/gopapercut/pclog"
+	"bitbucket.org/papercutsoftware/gopapercut/print/ippclient/v3"
+)
+
+// errUploadTooSlow The document upload fell below the minimum throughput. Not temporary, a retry would
+// most likely be as slow.
+type errUploadTooSlow struct {
+	sent       int64
+	throughput int64
+	minimum    int64
+}
+
+func (e *errUploadTooSlow) Error() string {
+	return fmt.Sprintf("document upload too slow: %d bytes sent at %d B/s, minimum %d B/s", e.sent, e.throughput, e.minimum)
+}
+
+func (e *errUploadTooSlow) Temporary() bool {
+	return false
+}
+
+// uploadTimeout How long a request uploading a document may take: the request timeout plus the time to upload
+// the document at the minimum throughput. The request timeout alone if the size isn't known yet, leaving slow uploads
+// to uploadProgress, and 0, no limit, if there is no minimum.
+func uploadTimeout(size int64, requestTimeout time.Duration, minThroughput int64) time.Duration {
+	if minThroughput <= 0 {
+		return 0
+	}
+	if size < 0 {
+		return requestTimeout
+	}
+	return requestTimeout + time.Duration(size/minThroughput)*time.Second
+}
+
+// uploadProgress Counts the bytes of a document read by an upload, reporting progress at intervals and failing
+// the upload with errUploadTooSlow if, after the grace period, the average throughput is below the minimum.
+type uploadProgress struct {
+	io.Reader
+	operation     string
+	attempt       int
+	size          int64
+	interval      time.Duration
+	grace         time.Duration
+	minThroughput int64 // Bytes per second, 0 for no minimum.
+
+	sent       int64
+	start      time.Time
+	lastReport time.Time
+}
+
+func newUploadProgress(r io.Reader, operation string, attempt int, size int64, grace time.Duration) *uploadProgress {
+	now := time.Now()
+	return &uploadProgress{
+		Reader:        r,
+		operation:     operation,
+		attempt:       attempt,
+		size:          size,
+		interval:      time.Duration(*uploadProgressIntervalSec) * time.Second,
+		grace:         grace,
+		minThroughput: int64(*uploadMinThroughputKBps) * 1024,
+		start:         now,
+		lastReport:    now,
+	}
+}
+
+func (u *uploadProgress) Read(b []byte) (int, error) {
+	n, err := u.Reader.Read(b)
+	u.sent += int64(n)
+
+	now := time.Now()
+	elapsed := now.Sub(u.start)
+	if u.interval > 0 && now.Sub(u.lastReport) >= u.interval {
+		u.lastReport = now
+		u.report("upload progress", elapsed)
+	}
+	if u.minThroughput > 0 && elapsed > u.grace && err == nil {
+		if throughput := u.throughput(elapsed); throughput < u.minThroughput {
+			tooSlow := &errUploadTooSlow{sent: u.sent, throughput: throughput, minimum: u.minThroughput}
+			pclog.Errorf("%v", tooSlow)
+			return n, tooSlow
+		}
+	}
+	return n, err
+}
+
+func (u *uploadProgress) throughput(elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return u.sent
+	}
+	return int64(float64(u.sent) / elapsed.Seconds())
+}
+
+func (u *uploadProgress) report(what string, elapsed time.Duration) {
+	sent := fmt.Sprintf("%d", u.sent)
+	if u.size >= 0 {
+		sent = fmt.Sprintf("%d/%d", u.sent, u.size)
+	}
+	msg := fmt.Sprintf("%s: %s bytes sent, %d B/s", what, sent, u.throughput(elapsed))
+	pclog.Devf(msg)
+	processingLogger.LogOperationAttempt(u.operation, u.attempt, msg, elapsed.String())
+}
+
+// finish Report the whole upload.
+func (u *uploadProgress) finish() {
+	u.report("upload complete", time.Since(u.start))
+}
+
+// uploadClient A client for a request uploading a document of the given size, its timeout allowing for the size.
+// The client's own timeout is only meant for requests without a document. Returns the printer's client if the
+// HTTP client can't be copied. The returned close function closes the client if it was created.
+func (p *ippPrinter) uploadClient(size int64) (*ippclient.IPPClient, time.Duration, func()) {
+	httpClient, ok := p.httpClient.(*http.Client)
+	if !ok {
+		return p.ippClient, defaultHttpRequestTimeoutSec * time.Second, func() {}
+	}
+
+	upload := *httpClient
+	upload.Timeout = uploadTimeout(size, httpClient.Timeout, int64(*uploadMinThroughputKBps)*1024)
+	client, err := ippclient.NewIPPClient(ippclient.SetHTTPClient(&upload))
+	if err != nil {
+		pclog.Devf("failed to create upload client, using the request timeout: %v", err)
+		return p.ippClient, httpClient.Timeout, func() {}
+	}
+	pclog.Devf("upload timeout %v for %d bytes", upload.Timeout, size)
+	return client, httpClient.Timeout, func() {
+		if err := client.Close(); err != nil {
+			pclog.Devf("failed to close upload client: %v", err)
+		}
+	}
+}
+
+// upload Prepare a document upload: the document, compressed if the job is and with its progress reported, and
+// the client to send it with. finish must be called once the operation returns.
+func (p *ippPrinter) upload(file readCloseResetter, docFormat, operation string, attempt int) (*ippclient.Document, *ippclient.IPPClient, func()) {
+	size := file.Size()
+	client, grace, closeClient := p.uploadClient(size)
+
+	document, finishDocument := p.document(file, docFormat)
+	if document.Compression != "" {
+		// Progress counts the compressed bytes.
+		size = -1
+	}
+	progress := newUploadProgress(document.Reader, operation, attempt, size, grace)
+	document.Reader = progress
+
+	return document, client, func() {
+		progress.finish()
+		finishDocument(operation, attempt)
+		closeClient()
+	}
+}
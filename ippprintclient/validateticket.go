@@ -0,0 +1,60 @@
+package ippprintclient
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"bitbucket.org/papercutsoftware/pmitc-coordinator/ippprintclient/jobticket"
+)
+
+// validateTicketCommand Check a job ticket without a printer, listing every problem found on w.
+// With -schema, print the job ticket JSON Schema instead.
+func validateTicketCommand(w io.Writer, args []string, ticketPath string) error {
+	opErr := &OperationError{
+		Type: ErrValidateTicket,
+	}
+
+	flags := flag.NewFlagSet("validate-ticket", flag.ContinueOnError)
+	schema := flags.Bool("schema", false, "print the job ticket JSON Schema")
+	if err := flags.Parse(args); err != nil {
+		opErr.Err = err
+		return opErr
+	}
+
+	if *schema {
+		data, err := jobticket.Schema()
+		if err != nil {
+			opErr.Err = err
+			return opErr
+		}
+		_, _ = fmt.Fprintln(w, string(data))
+		return nil
+	}
+
+	if ticketPath == "" {
+		opErr.Err = fmt.Errorf("ticketPath empty")
+		return opErr
+	}
+
+	_, err := jobticket.GetPrintJobAttributes(ticketPath)
+	if err == nil {
+		_, _ = fmt.Fprintf(w, "%s: ok\n", ticketPath)
+		return nil
+	}
+
+	var validationErr *jobticket.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, problem := range validationErr.Problems {
+			_, _ = fmt.Fprintf(w, "%s: %v\n", ticketPath, problem)
+		}
+	} else {
+		_, _ = fmt.Fprintf(w, "%s: %v\n", ticketPath, err)
+	}
+
+	return &OperationError{
+		Type: ErrValidateTicketInvalid,
+		Err:  err,
+	}
+}
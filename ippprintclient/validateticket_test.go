@@ -0,0 +1,92 @@
+package ippprintclient
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestTicket(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write ticket: %v", err)
+	}
+	return path
+}
+
+func TestValidateTicketCommand_Valid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validateticket")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	jsonTicket := writeTestTicket(t, dir, "ticket.json", `{"Version": 1, "Copies": 2, "PrintColorMode": "color", "Sides": "one-sided",
+		"DocumentFormat": "application/pdf", "PaperName": "A4", "PaperWidthMM": 210, "PaperHeightMM": 297}`)
+	yamlTicket := writeTestTicket(t, dir, "ticket.yaml", `
+Copies: 2
+PrintColorMode: color
+Sides: one-sided
+DocumentFormat: application/pdf
+PaperName: A4
+PaperWidthMM: 210
+PaperHeightMM: 297
+Finishings: [staple-top-left]
+OptionalPDLOverrides:
+  Orientation: landscape
+`)
+
+	autoTicket := writeTestTicket(t, dir, "auto.json", `{"Copies": 1, "PrintColorMode": "color", "Sides": "one-sided",
+		"DocumentFormat": "application/pdf", "PaperName": "auto"}`)
+
+	for _, path := range []string{jsonTicket, yamlTicket, autoTicket} {
+		var out bytes.Buffer
+		if err := validateTicketCommand(&out, nil, path); err != nil {
+			t.Fatalf("expected %v to be valid, got %v: %v", path, err, out.String())
+		}
+	}
+}
+
+func TestValidateTicketCommand_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validateticket")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tests := map[string]struct {
+		name     string
+		content  string
+		problems []string
+	}{
+		"unknown field": {
+			name:     "ticket.json",
+			content:  `{"Copise": 2}`,
+			problems: []string{`unknown field "Copise"`},
+		},
+		"every problem": {
+			name:     "ticket.yml",
+			content:  "Version: 7\nCopies: 0\nPaperName: A4\nJobPriority: 200\n",
+			problems: []string{"Version:", "Copies:", "PrintColorMode:", "Sides:", "PaperWidthMM:", "PaperHeightMM:", "DocumentFormat:", "JobPriority:"},
+		},
+	}
+
+	for name, test := range tests {
+		var out bytes.Buffer
+		err := validateTicketCommand(&out, nil, writeTestTicket(t, dir, test.name, test.content))
+
+		var opErr *OperationError
+		if !errors.As(err, &opErr) || opErr.Type != ErrValidateTicketInvalid {
+			t.Fatalf("%s: expected ErrValidateTicketInvalid, got %v", name, err)
+		}
+		for _, problem := range test.problems {
+			if !strings.Contains(out.String(), problem) {
+				t.Fatalf("%s: expected %q to be reported, got %v", name, problem, out.String())
+			}
+		}
+	}
+}